@@ -0,0 +1,186 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	Collection = "apiKeys"
+	// Header is the request header that carries the API key.
+	Header = "X-Api-Key"
+	prefix = "smk_"
+)
+
+var (
+	ErrMissingKey    = errors.New("an API key is required")
+	ErrInvalidKey    = errors.New("invalid or revoked API key")
+	ErrWrongInstance = errors.New("the API key is not valid for this instance")
+)
+
+// Policy decides which requests must carry an API key. Keys are checked whenever they are sent, even if they are
+// not required.
+type Policy struct {
+	Required bool
+	// V1UnauthenticatedUntil lets v1 instances report without a key until then, while they are upgraded.
+	V1UnauthenticatedUntil time.Time
+}
+
+// PolicyFromEnv reads the policy from API_KEYS_REQUIRED and V1_UNAUTHENTICATED_UNTIL, an RFC 3339 time.
+func PolicyFromEnv() (Policy, error) {
+	var policy Policy
+	var err error
+	if value := os.Getenv("API_KEYS_REQUIRED"); value != "" {
+		policy.Required, err = strconv.ParseBool(value)
+		if err != nil {
+			return policy, errors.Wrap(err, "invalid API_KEYS_REQUIRED")
+		}
+	}
+	if value := os.Getenv("V1_UNAUTHENTICATED_UNTIL"); value != "" {
+		policy.V1UnauthenticatedUntil, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return policy, errors.Wrap(err, "invalid V1_UNAUTHENTICATED_UNTIL")
+		}
+	}
+	return policy, nil
+}
+
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// headerValue looks up a header regardless of case, since HTTP APIs lower case the header names and REST APIs do not.
+func headerValue(headers map[string]string, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// Create generates a key linked to the identity, and to a single instance if instanceID is set.
+// The key is only returned here; the database only stores its hash.
+func Create(ctx context.Context, db *mongo.Database, identity string, instanceID string, note string) (string, *model.APIKey, error) {
+	if identity == "" {
+		return "", nil, errors.New("an API key must be linked to an identity")
+	}
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to generate API key")
+	}
+	key := prefix + base64.RawURLEncoding.EncodeToString(b)
+	apiKey := &model.APIKey{
+		ID:         primitive.NewObjectID(),
+		Hash:       hash(key),
+		Prefix:     key[:len(prefix)+6],
+		Identity:   identity,
+		InstanceID: instanceID,
+		Note:       note,
+		CreatedAt:  time.Now().UTC(),
+	}
+	_, err = db.Collection(Collection).InsertOne(ctx, apiKey)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to insert API key")
+	}
+	return key, apiKey, nil
+}
+
+// Revoke revokes the key with the ID. Revoking a revoked key keeps its original revocation time.
+func Revoke(ctx context.Context, db *mongo.Database, id string) error {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return errors.Wrap(err, "invalid API key ID")
+	}
+	result, err := db.Collection(Collection).UpdateOne(ctx,
+		bson.M{"_id": objectID, "revokedAt": nil},
+		bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}})
+	if err != nil {
+		return errors.Wrap(err, "failed to revoke API key")
+	}
+	if result.MatchedCount == 0 {
+		count, err := db.Collection(Collection).CountDocuments(ctx, bson.M{"_id": objectID})
+		if err != nil {
+			return errors.Wrap(err, "failed to find API key")
+		}
+		if count == 0 {
+			return errors.Errorf("API key %s not found", id)
+		}
+	}
+	return nil
+}
+
+// List returns the keys, newest first, leaving out revoked keys unless all is set.
+func List(ctx context.Context, db *mongo.Database, all bool) ([]model.APIKey, error) {
+	filter := bson.M{"revokedAt": nil}
+	if all {
+		filter = bson.M{}
+	}
+	cursor, err := db.Collection(Collection).Find(ctx, filter, options.Find().SetSort(bson.M{"createdAt": -1}))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query API keys")
+	}
+	var keys []model.APIKey
+	err = cursor.All(ctx, &keys)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode API keys")
+	}
+	return keys, nil
+}
+
+// Authenticate returns the key sent with the request headers, or nil if none was sent and the policy allows it.
+func Authenticate(ctx context.Context, db *mongo.Database, policy Policy, headers map[string]string, isV1 bool) (*model.APIKey, error) {
+	key := headerValue(headers, Header)
+	if key == "" {
+		now := time.Now()
+		if !policy.Required || (isV1 && now.Before(policy.V1UnauthenticatedUntil)) {
+			return nil, nil
+		}
+		return nil, ErrMissingKey
+	}
+	var apiKey model.APIKey
+	err := db.Collection(Collection).FindOneAndUpdate(ctx,
+		bson.M{"hash": hash(key), "revokedAt": nil},
+		bson.M{"$set": bson.M{"lastUsedAt": time.Now().UTC()}}).Decode(&apiKey)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrInvalidKey
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to look up API key")
+	}
+	return &apiKey, nil
+}
+
+// IsUnauthorized tells whether an error of Authenticate is caused by the request rather than by the database.
+func IsUnauthorized(err error) bool {
+	return errors.Is(err, ErrMissingKey) || errors.Is(err, ErrInvalidKey)
+}
+
+// Attribute sets the identity of the key on the reporter, overriding what the payload claims, and checks that a key
+// linked to an instance is only used by that instance.
+func Attribute(apiKey *model.APIKey, reporter *model.Reporter) error {
+	if apiKey == nil {
+		return nil
+	}
+	if apiKey.InstanceID != "" && reporter.InstanceID != apiKey.InstanceID {
+		return ErrWrongInstance
+	}
+	reporter.Identity = apiKey.Identity
+	return nil
+}
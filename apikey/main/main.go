@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/apikey"
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// withDatabase connects to the metrics database for the duration of a command.
+func withDatabase(c *cli.Context, f func(db *mongo.Database) error) error {
+	mg, err := mongo.Connect(c.Context, options.Client().ApplyURI(c.String("mongodb-uri")))
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to mongo")
+	}
+	defer func() {
+		_ = mg.Disconnect(context.Background())
+	}()
+	return f(mg.Database("singularity"))
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func create(c *cli.Context) error {
+	return withDatabase(c, func(db *mongo.Database) error {
+		key, apiKey, err := apikey.Create(c.Context, db, c.String("identity"), c.String("instance-id"), c.String("note"))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created API key %s for %s\n", apiKey.ID.Hex(), apiKey.Identity)
+		fmt.Printf("send it in the %s header; it is not shown again:\n%s\n", apikey.Header, key)
+		return nil
+	})
+}
+
+func list(c *cli.Context) error {
+	return withDatabase(c, func(db *mongo.Database) error {
+		keys, err := apikey.List(c.Context, db, c.Bool("all"))
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tPREFIX\tIDENTITY\tINSTANCE\tCREATED AT\tLAST USED AT\tREVOKED AT\tNOTE")
+		for _, k := range keys {
+			instanceID := k.InstanceID
+			if instanceID == "" {
+				instanceID = "any"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", k.ID.Hex(), k.Prefix, k.Identity, instanceID,
+				k.CreatedAt.Format(time.RFC3339), formatTime(k.LastUsedAt), formatTime(k.RevokedAt), k.Note)
+		}
+		return errors.Wrap(tw.Flush(), "failed to write API keys")
+	})
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app := &cli.App{
+		Name:  "apikey",
+		Usage: "Manage the API keys that authenticate the reports of Singularity deployments",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "mongodb-uri",
+				Usage:   "MongoDB connection string",
+				EnvVars: []string{"MONGODB_URI"},
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "create",
+				Usage: "Create a key and print it",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "identity", Usage: "Identity the reports sent with the key are attributed to", Required: true},
+					&cli.StringFlag{Name: "instance-id", Usage: "Only accept the key from this instance"},
+					&cli.StringFlag{Name: "note", Usage: "Free text note, such as who the key was issued to"},
+				},
+				Action: create,
+			},
+			{
+				Name:      "revoke",
+				Usage:     "Revoke a key",
+				ArgsUsage: "<id>",
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return errors.New("expected the ID of the key to revoke")
+					}
+					return withDatabase(c, func(db *mongo.Database) error {
+						return apikey.Revoke(c.Context, db, c.Args().First())
+					})
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List the keys",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "all", Usage: "Include revoked keys"},
+				},
+				Action: list,
+			},
+		},
+	}
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,265 @@
+package dataset
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	Collection         = "datasets"
+	ProgressCollection = "datasetProgress"
+	// pieceBatchSize is the number of piece CIDs whose active deals are looked up with a single query.
+	pieceBatchSize = 10000
+)
+
+// KeyOf returns the dataset of a v1 car. Singularity v2 does not report which dataset a car belongs to, so v2 cars
+// are left out of the datasets.
+func KeyOf(car model.Car) model.DatasetKey {
+	key := model.DatasetKey{
+		Reporter:    car.Identity,
+		DatasetName: car.DatasetName,
+	}
+	if key.Reporter == "" {
+		key.Reporter = car.InstanceID
+	}
+	if car.DatasetID != nil {
+		key.DatasetID = *car.DatasetID
+	}
+	return key
+}
+
+// Record adds newly ingested v1 cars to the running totals of their datasets, creating the datasets as needed.
+func Record(ctx context.Context, db *mongo.Database, cars []model.Car) error {
+	datasets := make(map[model.DatasetKey]*model.Dataset)
+	for _, car := range cars {
+		if !car.IsV1 {
+			continue
+		}
+		key := KeyOf(car)
+		d, ok := datasets[key]
+		if !ok {
+			d = &model.Dataset{Key: key, IsV1: car.IsV1, FirstSeenAt: car.CreatedAt, LastSeenAt: car.CreatedAt}
+			datasets[key] = d
+		}
+		d.Cars++
+		d.Bytes += car.FileSize
+		if car.CreatedAt.Before(d.FirstSeenAt) {
+			d.FirstSeenAt = car.CreatedAt
+		}
+		if car.CreatedAt.After(d.LastSeenAt) {
+			d.LastSeenAt = car.CreatedAt
+		}
+	}
+	for key, d := range datasets {
+		_, err := db.Collection(Collection).UpdateOne(ctx, bson.M{"_id": key}, bson.M{
+			"$inc":         bson.M{"cars": d.Cars, "bytes": d.Bytes},
+			"$min":         bson.M{"firstSeenAt": d.FirstSeenAt},
+			"$max":         bson.M{"lastSeenAt": d.LastSeenAt},
+			"$setOnInsert": bson.M{"isV1": d.IsV1},
+		}, options.Update().SetUpsert(true))
+		if err != nil {
+			return errors.Wrap(err, "failed to update dataset")
+		}
+	}
+	return nil
+}
+
+// activeReplicas returns the number of distinct providers with an active deal for each of the pieces.
+func activeReplicas(ctx context.Context, db *mongo.Database, pieceCIDs []string) (map[string]int64, error) {
+	cursor, err := db.Collection("deals").Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"pieceCid": bson.M{"$in": pieceCIDs}, "state": "active"}},
+		bson.M{"$group": bson.M{"_id": "$pieceCid", "providers": bson.M{"$addToSet": "$provider"}}},
+		bson.M{"$project": bson.M{"replicas": bson.M{"$size": "$providers"}}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to aggregate active deals")
+	}
+	defer cursor.Close(ctx)
+	var rows []struct {
+		PieceCID string `bson:"_id"`
+		Replicas int64  `bson:"replicas"`
+	}
+	err = cursor.All(ctx, &rows)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode active deals")
+	}
+	result := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		result[row.PieceCID] = row.Replicas
+	}
+	return result, nil
+}
+
+type datasetPiece struct {
+	key      model.DatasetKey
+	pieceCID string
+}
+
+// Refresh recomputes the totals of every dataset from v1 cars and deals, and records a progress snapshot of each.
+// Cars ingested while the refresh runs may be counted twice or not at all until the next refresh.
+func Refresh(ctx context.Context, db *mongo.Database) (int, error) {
+	now := time.Now().UTC()
+	// Earlier versions recorded every v2 car of a reporter as a single dataset.
+	_, err := db.Collection(Collection).DeleteMany(ctx, bson.M{"isV1": false})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to remove v2 datasets")
+	}
+	cursor, err := db.Collection("cars").Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"isV1": true}},
+		bson.M{"$group": bson.M{
+			"_id": bson.M{
+				"reporter": bson.M{"$cond": bson.A{
+					bson.M{"$gt": bson.A{bson.M{"$ifNull": bson.A{"$identity", ""}}, ""}},
+					"$identity",
+					"$instanceId",
+				}},
+				"datasetId":   bson.M{"$ifNull": bson.A{"$datasetId", 0}},
+				"datasetName": bson.M{"$ifNull": bson.A{"$datasetName", ""}},
+				"pieceCid":    "$pieceCid",
+			},
+			"cars":        bson.M{"$sum": 1},
+			"bytes":       bson.M{"$sum": "$fileSize"},
+			"isV1":        bson.M{"$first": "$isV1"},
+			"firstSeenAt": bson.M{"$min": "$createdAt"},
+			"lastSeenAt":  bson.M{"$max": "$createdAt"},
+		}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to aggregate cars")
+	}
+	defer cursor.Close(ctx)
+
+	datasets := make(map[model.DatasetKey]*model.Dataset)
+	var batch []datasetPiece
+	flush := func() error {
+		pieceCIDs := make([]string, 0, len(batch))
+		for _, p := range batch {
+			pieceCIDs = append(pieceCIDs, p.pieceCID)
+		}
+		replicas, err := activeReplicas(ctx, db, pieceCIDs)
+		if err != nil {
+			return err
+		}
+		for _, p := range batch {
+			if n := replicas[p.pieceCID]; n > 0 {
+				datasets[p.key].ActivePieces++
+				datasets[p.key].Replicas += n
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				model.DatasetKey `bson:",inline"`
+				PieceCID         string `bson:"pieceCid"`
+			} `bson:"_id"`
+			Cars        int64     `bson:"cars"`
+			Bytes       int64     `bson:"bytes"`
+			IsV1        bool      `bson:"isV1"`
+			FirstSeenAt time.Time `bson:"firstSeenAt"`
+			LastSeenAt  time.Time `bson:"lastSeenAt"`
+		}
+		err = cursor.Decode(&row)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to decode cars")
+		}
+		key := row.ID.DatasetKey
+		d, ok := datasets[key]
+		if !ok {
+			d = &model.Dataset{Key: key, IsV1: row.IsV1, FirstSeenAt: row.FirstSeenAt, LastSeenAt: row.LastSeenAt}
+			datasets[key] = d
+		}
+		d.Cars += row.Cars
+		d.Bytes += row.Bytes
+		d.Pieces++
+		if row.FirstSeenAt.Before(d.FirstSeenAt) {
+			d.FirstSeenAt = row.FirstSeenAt
+		}
+		if row.LastSeenAt.After(d.LastSeenAt) {
+			d.LastSeenAt = row.LastSeenAt
+		}
+		batch = append(batch, datasetPiece{key: key, pieceCID: row.ID.PieceCID})
+		if len(batch) >= pieceBatchSize {
+			err = flush()
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, errors.Wrap(err, "failed to iterate cars")
+	}
+	if len(batch) > 0 {
+		err = flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var snapshots []any
+	for key, d := range datasets {
+		d.RefreshedAt = now
+		_, err = db.Collection(Collection).ReplaceOne(ctx, bson.M{"_id": key}, d, options.Replace().SetUpsert(true))
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to save dataset")
+		}
+		snapshots = append(snapshots, model.DatasetProgress{
+			Key:          key,
+			At:           now,
+			Cars:         d.Cars,
+			Bytes:        d.Bytes,
+			Pieces:       d.Pieces,
+			ActivePieces: d.ActivePieces,
+			Replicas:     d.Replicas,
+		})
+	}
+	if len(snapshots) > 0 {
+		_, err = db.Collection(ProgressCollection).InsertMany(ctx, snapshots)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to insert dataset progress")
+		}
+	}
+	log.Printf("refreshed %d datasets\n", len(datasets))
+	return len(datasets), nil
+}
+
+// List returns every dataset, most recently active first.
+func List(ctx context.Context, db *mongo.Database) ([]model.Dataset, error) {
+	cursor, err := db.Collection(Collection).Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"lastSeenAt": -1}))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get datasets")
+	}
+	defer cursor.Close(ctx)
+	var datasets []model.Dataset
+	err = cursor.All(ctx, &datasets)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode datasets")
+	}
+	return datasets, nil
+}
+
+// Progress returns the progress snapshots of a dataset taken since the given time, oldest first.
+func Progress(ctx context.Context, db *mongo.Database, key model.DatasetKey, since time.Time) ([]model.DatasetProgress, error) {
+	cursor, err := db.Collection(ProgressCollection).Find(ctx,
+		bson.M{"key": key, "at": bson.M{"$gte": since}},
+		options.Find().SetSort(bson.M{"at": 1}))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get dataset progress")
+	}
+	defer cursor.Close(ctx)
+	var progress []model.DatasetProgress
+	err = cursor.All(ctx, &progress)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode dataset progress")
+	}
+	return progress, nil
+}
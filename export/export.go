@@ -0,0 +1,170 @@
+package export
+
+import (
+	"context"
+	"io"
+	"log"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type Options struct {
+	Collection string
+	// Format is "csv", "jsonl" or "parquet".
+	Format string
+	// Zstd compresses CSV and JSON Lines output as a whole, and Parquet output by column chunk.
+	Zstd bool
+	// From and To select the documents created, or for verified clients updated, in the range if set.
+	From     time.Time
+	To       time.Time
+	State    string
+	Provider string
+	// Client selects deals by client address, client mappings by actor ID or account key,
+	// and verified clients by address or address ID.
+	Client string
+}
+
+// source describes how a collection is filtered and turned into rows.
+type source struct {
+	timeField string
+	prototype any
+	// filter adds the state, provider and client filters, returning an error for those the collection does not have.
+	filter func(opts Options, query bson.M) error
+	row    func(cursor *mongo.Cursor) (any, error)
+}
+
+func unsupported(name string, values ...string) error {
+	for _, v := range values {
+		if v != "" {
+			return errors.Errorf("%s cannot be filtered by state, provider or client", name)
+		}
+	}
+	return nil
+}
+
+var sources = map[string]source{
+	"cars": {
+		timeField: "createdAt",
+		prototype: CarRow{},
+		filter: func(opts Options, query bson.M) error {
+			return unsupported("cars", opts.State, opts.Provider, opts.Client)
+		},
+		row: func(cursor *mongo.Cursor) (any, error) {
+			var car model.Car
+			err := cursor.Decode(&car)
+			return carRow(car), err
+		},
+	},
+	"deals": {
+		timeField: "createdAt",
+		prototype: DealRow{},
+		filter: func(opts Options, query bson.M) error {
+			if opts.State != "" {
+				query["state"] = opts.State
+			}
+			if opts.Provider != "" {
+				query["provider"] = opts.Provider
+			}
+			if opts.Client != "" {
+				query["client"] = opts.Client
+			}
+			return nil
+		},
+		row: func(cursor *mongo.Cursor) (any, error) {
+			var deal model.Deal
+			err := cursor.Decode(&deal)
+			return dealRow(deal), err
+		},
+	},
+	"clients": {
+		prototype: ClientRow{},
+		filter: func(opts Options, query bson.M) error {
+			if opts.Client != "" {
+				query["$or"] = bson.A{bson.M{"actorId": opts.Client}, bson.M{"accountKey": opts.Client}}
+			}
+			return unsupported("clients", opts.State, opts.Provider)
+		},
+		row: func(cursor *mongo.Cursor) (any, error) {
+			var client model.ClientMapping
+			err := cursor.Decode(&client)
+			return clientRow(client), err
+		},
+	},
+	"verifiedClients": {
+		timeField: "updatedAt",
+		prototype: VerifiedClientRow{},
+		filter: func(opts Options, query bson.M) error {
+			if opts.Client != "" {
+				query["$or"] = bson.A{bson.M{"address": opts.Client}, bson.M{"addressId": opts.Client}}
+			}
+			return unsupported("verifiedClients", opts.State, opts.Provider)
+		},
+		row: func(cursor *mongo.Cursor) (any, error) {
+			var client model.VerifiedClient
+			err := cursor.Decode(&client)
+			return verifiedClientRow(client), err
+		},
+	},
+}
+
+// Export streams the documents of a collection matching the options to w, one row at a time,
+// and returns the number of rows written.
+func Export(ctx context.Context, db *mongo.Database, w io.Writer, opts Options) (int64, error) {
+	src, ok := sources[opts.Collection]
+	if !ok {
+		return 0, errors.Errorf("unknown collection %q", opts.Collection)
+	}
+	query := bson.M{}
+	err := src.filter(opts, query)
+	if err != nil {
+		return 0, err
+	}
+	if !opts.From.IsZero() || !opts.To.IsZero() {
+		if src.timeField == "" {
+			return 0, errors.Errorf("%s cannot be filtered by time", opts.Collection)
+		}
+		timeRange := bson.M{}
+		if !opts.From.IsZero() {
+			timeRange["$gte"] = opts.From
+		}
+		if !opts.To.IsZero() {
+			timeRange["$lt"] = opts.To
+		}
+		query[src.timeField] = timeRange
+	}
+
+	rw, err := NewWriter(w, opts.Format, opts.Zstd, src.prototype)
+	if err != nil {
+		return 0, err
+	}
+
+	cursor, err := db.Collection(opts.Collection).Find(ctx, query, options.Find().SetBatchSize(1000))
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to query %s", opts.Collection)
+	}
+	defer cursor.Close(ctx)
+	var count int64
+	for cursor.Next(ctx) {
+		row, err := src.row(cursor)
+		if err != nil {
+			return count, errors.Wrapf(err, "failed to decode %s", opts.Collection)
+		}
+		err = rw.Write(row)
+		if err != nil {
+			return count, err
+		}
+		count++
+		if count%100000 == 0 {
+			log.Printf("exported %d %s\n", count, opts.Collection)
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return count, errors.Wrapf(err, "failed to iterate %s", opts.Collection)
+	}
+	return count, rw.Close()
+}
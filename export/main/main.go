@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/export"
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func exportAction(c *cli.Context) error {
+	opts := export.Options{
+		Collection: c.Args().First(),
+		Format:     c.String("format"),
+		Zstd:       c.Bool("zstd"),
+		State:      c.String("state"),
+		Provider:   c.String("provider"),
+		Client:     c.String("client"),
+	}
+	if t := c.Timestamp("from"); t != nil {
+		opts.From = *t
+	}
+	if t := c.Timestamp("to"); t != nil {
+		opts.To = *t
+	}
+
+	out := os.Stdout
+	if path := c.String("output"); path != "" && path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return errors.Wrap(err, "failed to create output file")
+		}
+		defer f.Close()
+		out = f
+	}
+
+	mg, err := mongo.Connect(c.Context, options.Client().ApplyURI(c.String("mongodb-uri")))
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to mongo")
+	}
+	defer func() {
+		_ = mg.Disconnect(context.Background())
+	}()
+	count, err := export.Export(c.Context, mg.Database("singularity"), out, opts)
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d %s\n", count, opts.Collection)
+	if out != os.Stdout {
+		return errors.Wrap(out.Close(), "failed to write output")
+	}
+	return nil
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app := &cli.App{
+		Name:      "export",
+		Usage:     "Export cars, deals, clients or verifiedClients from the metrics database",
+		ArgsUsage: "<collection>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "mongodb-uri", Usage: "MongoDB connection string", EnvVars: []string{"MONGODB_URI"}},
+			&cli.StringFlag{Name: "format", Usage: "Output format, csv, jsonl or parquet", Value: "csv"},
+			&cli.StringFlag{Name: "output", Aliases: []string{"o"}, Usage: "Output file, standard output if not set"},
+			&cli.BoolFlag{Name: "zstd", Usage: "Compress the output with zstd"},
+			&cli.TimestampFlag{Name: "from", Usage: "Only export documents created at or after this time", Layout: time.RFC3339},
+			&cli.TimestampFlag{Name: "to", Usage: "Only export documents created before this time", Layout: time.RFC3339},
+			&cli.StringFlag{Name: "state", Usage: "Only export deals in this state"},
+			&cli.StringFlag{Name: "provider", Usage: "Only export deals with this provider"},
+			&cli.StringFlag{Name: "client", Usage: "Only export deals, clients or verified clients with this client address"},
+		},
+		Action: exportAction,
+	}
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,176 @@
+package export
+
+import (
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+)
+
+// Rows are flat records with a column per field. Fields tagged with export:"time" hold Unix milliseconds,
+// and are written as timestamps in every format.
+
+type CarRow struct {
+	InstanceID  string  `json:"instanceId" parquet:"name=instanceId, type=BYTE_ARRAY, convertedtype=UTF8"`
+	IsV1        bool    `json:"isV1" parquet:"name=isV1, type=BOOLEAN"`
+	Identity    string  `json:"identity" parquet:"name=identity, type=BYTE_ARRAY, convertedtype=UTF8"`
+	IP          string  `json:"ip" parquet:"name=ip, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Country     string  `json:"country" parquet:"name=country, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Region      string  `json:"region" parquet:"name=region, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ASN         int64   `json:"asn" parquet:"name=asn, type=INT64"`
+	DatasetID   *int64  `json:"datasetId" parquet:"name=datasetId, type=INT64, repetitiontype=OPTIONAL"`
+	DatasetName string  `json:"datasetName" parquet:"name=datasetName, type=BYTE_ARRAY, convertedtype=UTF8"`
+	CreatedAt   int64   `json:"createdAt" export:"time" parquet:"name=createdAt, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	CarID       int64   `json:"carId" parquet:"name=carId, type=INT64"`
+	PieceCID    string  `json:"pieceCid" parquet:"name=pieceCid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PieceSize   int64   `json:"pieceSize" parquet:"name=pieceSize, type=INT64"`
+	FileSize    int64   `json:"fileSize" parquet:"name=fileSize, type=INT64"`
+	NumOfFiles  int64   `json:"numOfFiles" parquet:"name=numOfFiles, type=INT64"`
+	TimeSpentMs float64 `json:"timeSpentMs" parquet:"name=timeSpentMs, type=DOUBLE"`
+}
+
+type DealRow struct {
+	ID               string  `json:"id" parquet:"name=id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	InstanceID       string  `json:"instanceId" parquet:"name=instanceId, type=BYTE_ARRAY, convertedtype=UTF8"`
+	IsV1             bool    `json:"isV1" parquet:"name=isV1, type=BOOLEAN"`
+	Identity         string  `json:"identity" parquet:"name=identity, type=BYTE_ARRAY, convertedtype=UTF8"`
+	IP               string  `json:"ip" parquet:"name=ip, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Country          string  `json:"country" parquet:"name=country, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Region           string  `json:"region" parquet:"name=region, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ASN              int64   `json:"asn" parquet:"name=asn, type=INT64"`
+	CreatedAt        int64   `json:"createdAt" export:"time" parquet:"name=createdAt, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	DealID           *int64  `json:"dealId" parquet:"name=dealId, type=INT64, repetitiontype=OPTIONAL"`
+	DatasetID        *int64  `json:"datasetId" parquet:"name=datasetId, type=INT64, repetitiontype=OPTIONAL"`
+	Client           string  `json:"client" parquet:"name=client, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Provider         string  `json:"provider" parquet:"name=provider, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Label            string  `json:"label" parquet:"name=label, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PieceCID         string  `json:"pieceCid" parquet:"name=pieceCid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PieceSize        int64   `json:"pieceSize" parquet:"name=pieceSize, type=INT64"`
+	State            string  `json:"state" parquet:"name=state, type=BYTE_ARRAY, convertedtype=UTF8"`
+	StartEpoch       *int32  `json:"startEpoch" parquet:"name=startEpoch, type=INT32, repetitiontype=OPTIONAL"`
+	SectorStartEpoch *int32  `json:"sectorStartEpoch" parquet:"name=sectorStartEpoch, type=INT32, repetitiontype=OPTIONAL"`
+	EndEpoch         *int32  `json:"endEpoch" parquet:"name=endEpoch, type=INT32, repetitiontype=OPTIONAL"`
+	Duration         int32   `json:"duration" parquet:"name=duration, type=INT32"`
+	Verified         bool    `json:"verified" parquet:"name=verified, type=BOOLEAN"`
+	KeepUnsealed     *bool   `json:"keepUnsealed" parquet:"name=keepUnsealed, type=BOOLEAN, repetitiontype=OPTIONAL"`
+	Price            float64 `json:"price" parquet:"name=price, type=DOUBLE"`
+	PublishedAt      *int64  `json:"publishedAt" export:"time" parquet:"name=publishedAt, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+}
+
+type ClientRow struct {
+	ID         string `json:"id" parquet:"name=id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ActorID    string `json:"actorId" parquet:"name=actorId, type=BYTE_ARRAY, convertedtype=UTF8"`
+	AccountKey string `json:"accountKey" parquet:"name=accountKey, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+type VerifiedClientRow struct {
+	ID               int32  `json:"id" parquet:"name=id, type=INT32"`
+	AddressID        string `json:"addressId" parquet:"name=addressId, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Address          string `json:"address" parquet:"name=address, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Name             string `json:"name" parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	OrgName          string `json:"orgName" parquet:"name=orgName, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Region           string `json:"region" parquet:"name=region, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Website          string `json:"website" parquet:"name=website, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Industry         string `json:"industry" parquet:"name=industry, type=BYTE_ARRAY, convertedtype=UTF8"`
+	InitialAllowance string `json:"initialAllowance" parquet:"name=initialAllowance, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Allowances       int32  `json:"allowances" parquet:"name=allowances, type=INT32"`
+	Removed          bool   `json:"removed" parquet:"name=removed, type=BOOLEAN"`
+	Version          int32  `json:"version" parquet:"name=version, type=INT32"`
+	UpdatedAt        int64  `json:"updatedAt" export:"time" parquet:"name=updatedAt, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+}
+
+func millis(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+// geoColumns returns the country, region and ASN of a reporter, empty if it was not enriched.
+func geoColumns(reporter model.Reporter) (string, string, int64) {
+	if reporter.Geo == nil {
+		return "", "", 0
+	}
+	return reporter.Geo.Country, reporter.Geo.Region, int64(reporter.Geo.ASN)
+}
+
+func optionalUint32(v *uint32) *int64 {
+	if v == nil {
+		return nil
+	}
+	n := int64(*v)
+	return &n
+}
+
+func carRow(car model.Car) CarRow {
+	row := CarRow{
+		InstanceID:  car.InstanceID,
+		IsV1:        car.IsV1,
+		Identity:    car.Identity,
+		IP:          car.IP,
+		DatasetID:   optionalUint32(car.DatasetID),
+		DatasetName: car.DatasetName,
+		CreatedAt:   millis(car.CreatedAt),
+		CarID:       car.CarID,
+		PieceCID:    car.PieceCID,
+		PieceSize:   car.PieceSize,
+		FileSize:    car.FileSize,
+		NumOfFiles:  car.NumOfFiles,
+		TimeSpentMs: float64(car.TimeSpent) / float64(time.Millisecond),
+	}
+	row.Country, row.Region, row.ASN = geoColumns(car.Reporter)
+	return row
+}
+
+func dealRow(deal model.Deal) DealRow {
+	row := DealRow{
+		ID:               deal.ID.Hex(),
+		InstanceID:       deal.InstanceID,
+		IsV1:             deal.IsV1,
+		Identity:         deal.Identity,
+		IP:               deal.IP,
+		CreatedAt:        millis(deal.CreatedAt),
+		DatasetID:        optionalUint32(deal.DatasetID),
+		Client:           deal.Client,
+		Provider:         deal.Provider,
+		Label:            deal.Label,
+		PieceCID:         deal.PieceCID,
+		PieceSize:        deal.PieceSize,
+		State:            deal.State,
+		StartEpoch:       deal.StartEpoch,
+		SectorStartEpoch: deal.SectorStartEpoch,
+		EndEpoch:         deal.EndEpoch,
+		Duration:         deal.Duration,
+		Verified:         deal.Verified,
+		KeepUnsealed:     deal.KeepUnsealed,
+		Price:            deal.Price,
+	}
+	row.Country, row.Region, row.ASN = geoColumns(deal.Reporter)
+	if deal.DealID != nil {
+		dealID := int64(*deal.DealID)
+		row.DealID = &dealID
+	}
+	if deal.PublishedAt != nil {
+		publishedAt := millis(*deal.PublishedAt)
+		row.PublishedAt = &publishedAt
+	}
+	return row
+}
+
+func clientRow(client model.ClientMapping) ClientRow {
+	return ClientRow{ID: client.ID.Hex(), ActorID: client.ActorID, AccountKey: client.AccountKey}
+}
+
+func verifiedClientRow(client model.VerifiedClient) VerifiedClientRow {
+	return VerifiedClientRow{
+		ID:               client.ID,
+		AddressID:        client.AddressID,
+		Address:          client.Address,
+		Name:             client.Name,
+		OrgName:          client.OrgName,
+		Region:           client.Region,
+		Website:          client.Website,
+		Industry:         client.Industry,
+		InitialAllowance: client.InitialAllowance,
+		Allowances:       int32(len(client.Allowances)),
+		Removed:          client.Removed,
+		Version:          int32(client.Version),
+		UpdatedAt:        millis(client.UpdatedAt),
+	}
+}
@@ -0,0 +1,215 @@
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// RowWriter writes rows of a single type to an output.
+type RowWriter interface {
+	Write(row any) error
+	// Close flushes the rows written so far, without closing the underlying writer.
+	Close() error
+}
+
+type column struct {
+	name   string
+	index  int
+	isTime bool
+}
+
+func columnsOf(t reflect.Type) []column {
+	columns := make([]column, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		columns = append(columns, column{name: name, index: i, isTime: field.Tag.Get("export") == "time"})
+	}
+	return columns
+}
+
+// values returns the value of each column of a row, with nil for missing optional values.
+func values(columns []column, row any) []any {
+	v := reflect.ValueOf(row)
+	result := make([]any, 0, len(columns))
+	for _, c := range columns {
+		f := v.Field(c.index)
+		if f.Kind() == reflect.Pointer {
+			if f.IsNil() {
+				result = append(result, nil)
+				continue
+			}
+			f = f.Elem()
+		}
+		if c.isTime {
+			result = append(result, time.UnixMilli(f.Int()).UTC())
+			continue
+		}
+		result = append(result, f.Interface())
+	}
+	return result
+}
+
+type csvWriter struct {
+	w       *csv.Writer
+	columns []column
+}
+
+func newCSVWriter(w io.Writer, prototype any) (*csvWriter, error) {
+	columns := columnsOf(reflect.TypeOf(prototype))
+	header := make([]string, 0, len(columns))
+	for _, c := range columns {
+		header = append(header, c.name)
+	}
+	cw := csv.NewWriter(w)
+	err := cw.Write(header)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write header")
+	}
+	return &csvWriter{w: cw, columns: columns}, nil
+}
+
+func formatCSV(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (c *csvWriter) Write(row any) error {
+	vs := values(c.columns, row)
+	record := make([]string, 0, len(vs))
+	for _, v := range vs {
+		record = append(record, formatCSV(v))
+	}
+	return errors.Wrap(c.w.Write(record), "failed to write row")
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return errors.Wrap(c.w.Error(), "failed to flush rows")
+}
+
+type jsonlWriter struct {
+	encoder *json.Encoder
+	columns []column
+}
+
+func newJSONLWriter(w io.Writer, prototype any) *jsonlWriter {
+	return &jsonlWriter{encoder: json.NewEncoder(w), columns: columnsOf(reflect.TypeOf(prototype))}
+}
+
+func (j *jsonlWriter) Write(row any) error {
+	vs := values(j.columns, row)
+	record := make(map[string]any, len(vs))
+	for i, c := range j.columns {
+		record[c.name] = vs[i]
+	}
+	return errors.Wrap(j.encoder.Encode(record), "failed to write row")
+}
+
+func (j *jsonlWriter) Close() error {
+	return nil
+}
+
+type parquetWriter struct {
+	w *writer.ParquetWriter
+}
+
+// newParquetWriter writes row groups compressed with zstd if compress is set, or snappy otherwise.
+func newParquetWriter(w io.Writer, prototype any, compress bool) (*parquetWriter, error) {
+	// The schema is read from the struct tags of a pointer to the row type.
+	pw, err := writer.NewParquetWriterFromWriter(w, reflect.New(reflect.TypeOf(prototype)).Interface(), 4)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create parquet writer")
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	if compress {
+		pw.CompressionType = parquet.CompressionCodec_ZSTD
+	}
+	return &parquetWriter{w: pw}, nil
+}
+
+func (p *parquetWriter) Write(row any) error {
+	return errors.Wrap(p.w.Write(row), "failed to write row")
+}
+
+func (p *parquetWriter) Close() error {
+	return errors.Wrap(p.w.WriteStop(), "failed to write parquet footer")
+}
+
+// compressedWriter closes the compressor after the rows are flushed to it.
+type compressedWriter struct {
+	RowWriter
+	encoder *zstd.Encoder
+}
+
+func (c compressedWriter) Close() error {
+	err := c.RowWriter.Close()
+	if err != nil {
+		_ = c.encoder.Close()
+		return err
+	}
+	return errors.Wrap(c.encoder.Close(), "failed to flush compressed output")
+}
+
+// NewWriter writes rows of the same type as prototype in the format, "csv", "jsonl" or "parquet".
+// With compress, CSV and JSON Lines output is compressed as a whole with zstd, and Parquet output by column chunk.
+// Closing the writer does not close w.
+func NewWriter(w io.Writer, format string, compress bool, prototype any) (RowWriter, error) {
+	switch format {
+	case "csv", "jsonl":
+		var encoder *zstd.Encoder
+		if compress {
+			var err error
+			encoder, err = zstd.NewWriter(w)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to create compressor")
+			}
+			w = encoder
+		}
+		var rw RowWriter
+		if format == "csv" {
+			cw, err := newCSVWriter(w, prototype)
+			if err != nil {
+				return nil, err
+			}
+			rw = cw
+		} else {
+			rw = newJSONLWriter(w, prototype)
+		}
+		if encoder != nil {
+			return compressedWriter{RowWriter: rw, encoder: encoder}, nil
+		}
+		return rw, nil
+	case "parquet":
+		return newParquetWriter(w, prototype, compress)
+	default:
+		return nil, errors.Errorf("unknown export format %q", format)
+	}
+}
+
+// Extension returns the file name extension of the format.
+func Extension(format string, compress bool) string {
+	if compress && format != "parquet" {
+		return "." + format + ".zst"
+	}
+	return "." + format
+}
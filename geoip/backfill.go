@@ -0,0 +1,83 @@
+package geoip
+
+import (
+	"context"
+	"log"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const batchSize = 1000
+
+// Collections are the collections whose documents are enriched with the location of their reporter.
+var Collections = []string{"cars", "deals"}
+
+// backfillCollection enriches the documents of a collection that have an IP and no location yet.
+// Documents whose IP is in none of the databases are left as they are, and looked up again by the next backfill.
+func backfillCollection(ctx context.Context, db *mongo.Database, collection string, r *Resolver) (int64, error) {
+	cursor, err := db.Collection(collection).Find(ctx, bson.M{
+		"ip":  bson.M{"$nin": bson.A{"", nil}},
+		"geo": bson.M{"$exists": false},
+	}, options.Find().SetProjection(bson.M{"ip": 1}).SetBatchSize(batchSize))
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to query %s", collection)
+	}
+	defer cursor.Close(ctx)
+	var total int64
+	var writes []mongo.WriteModel
+	flush := func() error {
+		if len(writes) == 0 {
+			return nil
+		}
+		result, err := db.Collection(collection).BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return errors.Wrapf(err, "failed to enrich %s", collection)
+		}
+		total += result.ModifiedCount
+		writes = writes[:0]
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID any    `bson:"_id"`
+			IP string `bson:"ip"`
+		}
+		err = cursor.Decode(&doc)
+		if err != nil {
+			return total, errors.Wrapf(err, "failed to decode %s", collection)
+		}
+		geo := r.Lookup(doc.IP)
+		if geo == nil {
+			continue
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": doc.ID}).
+			SetUpdate(bson.M{"$set": bson.M{"geo": geo}}))
+		if len(writes) >= batchSize {
+			err = flush()
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return total, errors.Wrapf(err, "failed to iterate %s", collection)
+	}
+	return total, flush()
+}
+
+// Backfill enriches the stored cars and deals reported before enrichment was enabled.
+// Records whose IP was already truncated are located from the network prefix.
+func Backfill(ctx context.Context, db *mongo.Database, r *Resolver) error {
+	for _, collection := range Collections {
+		n, err := backfillCollection(ctx, db, collection, r)
+		if err != nil {
+			return err
+		}
+		log.Printf("enriched %d %s with their location\n", n, collection)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/oschwald/geoip2-golang"
+	"github.com/pkg/errors"
+)
+
+// Resolver looks up IP addresses in local MaxMind-format databases.
+type Resolver struct {
+	dbs []*geoip2.Reader
+}
+
+// Open opens GeoIP2 or GeoLite2 databases. Country and region are read from a City or Country database,
+// and the autonomous system from an ASN database.
+func Open(paths ...string) (*Resolver, error) {
+	r := &Resolver{}
+	for _, path := range paths {
+		db, err := geoip2.Open(path)
+		if err != nil {
+			_ = r.Close()
+			return nil, errors.Wrapf(err, "failed to open geoip database %s", path)
+		}
+		r.dbs = append(r.dbs, db)
+	}
+	return r, nil
+}
+
+// isCityDatabase tells whether a database holds regions. geoip2 also reads Country databases as City databases,
+// with no region.
+func isCityDatabase(db *geoip2.Reader) bool {
+	databaseType := db.Metadata().DatabaseType
+	return strings.Contains(databaseType, "City") || strings.Contains(databaseType, "Enterprise")
+}
+
+// Lookup returns the location of the IP, or nil if it is invalid or in none of the databases.
+// Databases that do not hold a kind of record are skipped for it. The country and region of a City database take
+// precedence over the country of a Country database, whatever their order.
+func (r *Resolver) Lookup(ip string) *model.Geo {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	var geo model.Geo
+	fromCity := false
+	for _, db := range r.dbs {
+		if isCityDatabase(db) {
+			if city, err := db.City(parsed); err == nil && !fromCity && city.Country.IsoCode != "" {
+				geo.Country = city.Country.IsoCode
+				if len(city.Subdivisions) > 0 {
+					geo.Region = city.Subdivisions[0].IsoCode
+				}
+				fromCity = true
+			}
+		} else if country, err := db.Country(parsed); err == nil && geo.Country == "" {
+			geo.Country = country.Country.IsoCode
+		}
+		if asn, err := db.ASN(parsed); err == nil {
+			geo.ASN = asn.AutonomousSystemNumber
+			geo.ASOrg = asn.AutonomousSystemOrganization
+		}
+	}
+	if geo == (model.Geo{}) {
+		return nil
+	}
+	return &geo
+}
+
+// Country returns the ISO country code of the IP, or an empty string if it is invalid or not in the databases.
+func (r *Resolver) Country(ip string) string {
+	geo := r.Lookup(ip)
+	if geo == nil {
+		return ""
+	}
+	return geo.Country
+}
+
+func (r *Resolver) Close() error {
+	var err error
+	for _, db := range r.dbs {
+		if closeErr := db.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// OpenFromEnv opens the databases named by GEOIP_DB and GEOIP_ASN_DB, and returns nil if neither is set.
+func OpenFromEnv() (*Resolver, error) {
+	var paths []string
+	for _, name := range []string{"GEOIP_DB", "GEOIP_ASN_DB"} {
+		if path := os.Getenv(name); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	return Open(paths...)
+}
@@ -0,0 +1,82 @@
+package geoip
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+)
+
+// The fixtures are written by testdata/generate.go. 1.2.3.0/24 is in every database, with a different country in
+// the City and Country databases, 5.6.7.0/24 is only in the Country database and 9.9.9.0/24 only in the ASN database.
+const (
+	cityDB    = "testdata/GeoLite2-City-Test.mmdb"
+	countryDB = "testdata/GeoLite2-Country-Test.mmdb"
+	asnDB     = "testdata/GeoLite2-ASN-Test.mmdb"
+)
+
+func openFixtures(t *testing.T, paths ...string) *Resolver {
+	t.Helper()
+	r, err := Open(paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = r.Close()
+	})
+	return r
+}
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name     string
+		paths    []string
+		ip       string
+		expected *model.Geo
+	}{
+		{"city and ASN", []string{cityDB, countryDB, asnDB}, "1.2.3.4",
+			&model.Geo{Country: "US", Region: "CA", ASN: 64500, ASOrg: "Example Net"}},
+		{"city preferred over country", []string{countryDB, cityDB}, "1.2.3.4",
+			&model.Geo{Country: "US", Region: "CA"}},
+		{"country fallback", []string{cityDB, countryDB, asnDB}, "5.6.7.8",
+			&model.Geo{Country: "DE"}},
+		{"country database only", []string{countryDB}, "1.2.3.4",
+			&model.Geo{Country: "FR"}},
+		{"ASN only", []string{cityDB, countryDB, asnDB}, "9.9.9.9",
+			&model.Geo{ASN: 64501, ASOrg: "Example Transit"}},
+		{"IPv4 mapped IPv6", []string{cityDB}, "::ffff:1.2.3.4",
+			&model.Geo{Country: "US", Region: "CA"}},
+		{"no match", []string{cityDB, countryDB, asnDB}, "10.0.0.1", nil},
+		{"IPv6 no match", []string{cityDB, countryDB, asnDB}, "2001:db8::1", nil},
+		{"invalid IP", []string{cityDB, countryDB, asnDB}, "not an ip", nil},
+		{"no databases", nil, "1.2.3.4", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			geo := openFixtures(t, test.paths...).Lookup(test.ip)
+			if !reflect.DeepEqual(geo, test.expected) {
+				t.Fatalf("Lookup(%q) = %+v, expected %+v", test.ip, geo, test.expected)
+			}
+		})
+	}
+}
+
+func TestCountry(t *testing.T) {
+	r := openFixtures(t, cityDB, countryDB, asnDB)
+	for ip, expected := range map[string]string{
+		"1.2.3.4":  "US",
+		"5.6.7.8":  "DE",
+		"9.9.9.9":  "",
+		"10.0.0.1": "",
+	} {
+		if country := r.Country(ip); country != expected {
+			t.Errorf("Country(%q) = %q, expected %q", ip, country, expected)
+		}
+	}
+}
+
+func TestOpenMissingDatabase(t *testing.T) {
+	if _, err := Open(cityDB, "testdata/missing.mmdb"); err == nil {
+		t.Fatal("expected an error for a missing database")
+	}
+}
@@ -0,0 +1,72 @@
+//go:build ignore
+
+// This program writes the fixture databases of the geoip tests. It needs github.com/maxmind/mmdbwriter, which the
+// module does not require, so run it from a module that does:
+//
+//	go run generate.go
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+type record struct {
+	network string
+	data    mmdbtype.Map
+}
+
+func country(isoCode string) mmdbtype.Map {
+	return mmdbtype.Map{"iso_code": mmdbtype.String(isoCode)}
+}
+
+func write(path string, databaseType string, records []record) {
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: databaseType, RecordSize: 24})
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range records {
+		_, network, err := net.ParseCIDR(r.network)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := tree.Insert(network, r.data); err != nil {
+			log.Fatal(err)
+		}
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := tree.WriteTo(f); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func main() {
+	write("GeoLite2-City-Test.mmdb", "GeoLite2-City", []record{
+		{"1.2.3.0/24", mmdbtype.Map{
+			"country":      country("US"),
+			"subdivisions": mmdbtype.Slice{country("CA")},
+		}},
+	})
+	write("GeoLite2-Country-Test.mmdb", "GeoLite2-Country", []record{
+		{"1.2.3.0/24", mmdbtype.Map{"country": country("FR")}},
+		{"5.6.7.0/24", mmdbtype.Map{"country": country("DE")}},
+	})
+	write("GeoLite2-ASN-Test.mmdb", "GeoLite2-ASN", []record{
+		{"1.2.3.0/24", mmdbtype.Map{
+			"autonomous_system_number":       mmdbtype.Uint32(64500),
+			"autonomous_system_organization": mmdbtype.String("Example Net"),
+		}},
+		{"9.9.9.0/24", mmdbtype.Map{
+			"autonomous_system_number":       mmdbtype.Uint32(64501),
+			"autonomous_system_organization": mmdbtype.String("Example Transit"),
+		}},
+	})
+}
@@ -0,0 +1,98 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/data-preservation-programs/singularity-metrics/purge"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var client *mongo.Client
+var token string
+var auditKey []byte
+
+func init() {
+	var err error
+	client, err = mongo.Connect(context.Background(), options.Client().ApplyURI(os.Getenv("MONGODB_URI")))
+	if err != nil {
+		panic(err)
+	}
+	token = os.Getenv("ADMIN_API_TOKEN")
+	auditKey = []byte(os.Getenv("PURGE_AUDIT_KEY"))
+}
+
+func handleError(err error, msg string, status int) (events.APIGatewayProxyResponse, error) {
+	err = errors.Wrap(err, msg)
+	log.Println(err.Error())
+	return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: status}, nil
+}
+
+// authorized checks the bearer token of the request. Every request is refused if ADMIN_API_TOKEN is not set.
+func authorized(request events.APIGatewayProxyRequest) bool {
+	header := request.Headers["Authorization"]
+	if header == "" {
+		header = request.Headers["authorization"]
+	}
+	if token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) == 1
+}
+
+// HandleRequest serves the admin action named by the {action} path parameter, e.g. POST /admin/purge with
+// {"identity": "...", "mode": "delete", "reason": "...", "requestedBy": "..."}
+// Purges are dry runs that only count the selected records unless "confirm" is true.
+func HandleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if !authorized(request) {
+		return handleError(errors.New("missing or invalid admin token"), "failed to authenticate the request", 401)
+	}
+	var result any
+	switch request.PathParameters["action"] {
+	case "purge":
+		if request.HTTPMethod != "POST" {
+			return handleError(errors.Errorf("method %s not allowed", request.HTTPMethod), "failed to route the request", 405)
+		}
+		var body struct {
+			purge.Request
+			Confirm bool `json:"confirm"`
+		}
+		err := json.Unmarshal([]byte(request.Body), &body)
+		if err != nil {
+			return handleError(err, "failed to unmarshal the body", 400)
+		}
+		if body.Reason == "" || body.RequestedBy == "" {
+			return handleError(errors.New("reason and requestedBy are required"), "invalid purge request", 400)
+		}
+		err = body.Request.Validate()
+		if err != nil {
+			return handleError(err, "invalid purge request", 400)
+		}
+		body.Request.DryRun = !body.Confirm
+		body.Request.AuditKey = auditKey
+		audit, err := purge.Purge(ctx, client.Database("singularity"), body.Request)
+		if err != nil {
+			return handleError(err, "failed to purge", 500)
+		}
+		result = audit
+	default:
+		return handleError(errors.Errorf("unknown action %q", request.PathParameters["action"]), "failed to route the request", 404)
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return handleError(err, "failed to marshal the response", 500)
+	}
+	return events.APIGatewayProxyResponse{
+		Body:       string(body),
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
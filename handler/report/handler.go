@@ -0,0 +1,186 @@
+package report
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/data-preservation-programs/singularity-metrics/instance"
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/data-preservation-programs/singularity-metrics/report"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var client *mongo.Client
+var token string
+
+// protected lists the reports that expose the identities and IPs of instances, which require the admin token.
+var protected = map[string]bool{
+	"instances":       true,
+	"quiet-instances": true,
+}
+
+func init() {
+	var err error
+	client, err = mongo.Connect(context.Background(), options.Client().ApplyURI(os.Getenv("MONGODB_URI")))
+	if err != nil {
+		panic(err)
+	}
+	token = os.Getenv("ADMIN_API_TOKEN")
+}
+
+func handleError(err error, msg string, status int) (events.APIGatewayProxyResponse, error) {
+	err = errors.Wrap(err, msg)
+	log.Println(err.Error())
+	return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: status}, nil
+}
+
+// authorized checks the bearer token of the request. Every request is refused if ADMIN_API_TOKEN is not set.
+func authorized(request events.APIGatewayProxyRequest) bool {
+	header := request.Headers["Authorization"]
+	if header == "" {
+		header = request.Headers["authorization"]
+	}
+	if token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) == 1
+}
+
+func intParameter(query map[string]string, name string, defaultValue int) (int, error) {
+	value, ok := query[name]
+	if !ok || value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
+
+func timeParameter(query map[string]string, name string, defaultValue time.Time) (time.Time, error) {
+	value, ok := query[name]
+	if !ok || value == "" {
+		return defaultValue, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// HandleRequest serves the report named by the {report} path parameter, e.g. GET /report/datacap?client=f01234
+// Reports are returned as JSON, or as Markdown with ?format=markdown if the report supports it. The instances and
+// quiet-instances reports require the admin bearer token.
+func HandleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if protected[request.PathParameters["report"]] && !authorized(request) {
+		return handleError(errors.New("missing or invalid admin token"), "failed to authenticate the request", 401)
+	}
+	db := client.Database("singularity")
+	query := request.QueryStringParameters
+	var result any
+	var err error
+	switch request.PathParameters["report"] {
+	case "datacap":
+		result, err = report.Datacap(ctx, db, query["client"])
+	case "compliance":
+		result, err = report.Compliance(ctx, db, query["client"])
+	case "replication":
+		opts := report.DefaultReplicationOptions
+		if opts.TargetReplicas, err = intParameter(query, "target", opts.TargetReplicas); err != nil {
+			return handleError(err, "invalid target", 400)
+		}
+		if opts.Days, err = intParameter(query, "days", opts.Days); err != nil {
+			return handleError(err, "invalid days", 400)
+		}
+		result, err = report.Replication(ctx, db, opts)
+	case "latency":
+		opts := report.DefaultLatencyOptions
+		if value := query["by"]; value != "" {
+			opts.By = value
+		}
+		if opts.Days, err = intParameter(query, "days", opts.Days); err != nil {
+			return handleError(err, "invalid days", 400)
+		}
+		opts.Provider = query["provider"]
+		opts.Client = query["client"]
+		result, err = report.Latency(ctx, db, opts)
+	case "scorecard":
+		var window int
+		if window, err = intParameter(query, "window", report.DefaultScorecardWindow); err != nil {
+			return handleError(err, "invalid window", 400)
+		}
+		result, err = report.Scorecard(ctx, db, window, query["provider"])
+	case "stranded":
+		opts := report.DefaultStrandedOptions
+		if opts.MinAgeDays, err = intParameter(query, "minAgeDays", opts.MinAgeDays); err != nil {
+			return handleError(err, "invalid minAgeDays", 400)
+		}
+		if opts.MaxAgeDays, err = intParameter(query, "maxAgeDays", opts.MaxAgeDays); err != nil {
+			return handleError(err, "invalid maxAgeDays", 400)
+		}
+		result, err = report.Stranded(ctx, db, opts)
+	case "datasets":
+		result, err = report.Datasets(ctx, db)
+	case "dataset-progress":
+		var datasetID int
+		if datasetID, err = intParameter(query, "datasetId", 0); err != nil {
+			return handleError(err, "invalid datasetId", 400)
+		}
+		var since time.Time
+		if since, err = timeParameter(query, "since", time.Now().AddDate(0, 0, -30)); err != nil {
+			return handleError(err, "invalid since", 400)
+		}
+		key := model.DatasetKey{Reporter: query["reporter"], DatasetID: uint32(datasetID), DatasetName: query["datasetName"]}
+		result, err = report.DatasetProgress(ctx, db, key, since)
+	case "instances":
+		filter := instance.Filter{Identity: query["identity"], IP: query["ip"]}
+		if value := query["isV1"]; value != "" {
+			var isV1 bool
+			if isV1, err = strconv.ParseBool(value); err != nil {
+				return handleError(err, "invalid isV1", 400)
+			}
+			filter.IsV1 = &isV1
+		}
+		if filter.SeenSince, err = timeParameter(query, "seenSince", time.Time{}); err != nil {
+			return handleError(err, "invalid seenSince", 400)
+		}
+		result, err = report.Instances(ctx, db, filter)
+	case "quiet-instances":
+		var days int
+		if days, err = intParameter(query, "days", report.DefaultQuietDays); err != nil {
+			return handleError(err, "invalid days", 400)
+		}
+		result, err = report.QuietInstances(ctx, db, days)
+	default:
+		return handleError(errors.Errorf("unknown report %q", request.PathParameters["report"]), "failed to route the request", 404)
+	}
+	switch {
+	case errors.Is(err, report.ErrInvalidRequest):
+		return handleError(err, "invalid report request", 400)
+	case errors.Is(err, report.ErrNotFound):
+		return handleError(err, "failed to generate the report", 404)
+	case err != nil:
+		return handleError(err, "failed to generate the report", 500)
+	}
+
+	if markdowner, ok := result.(report.Markdowner); ok && query["format"] == "markdown" {
+		return events.APIGatewayProxyResponse{
+			Body:       markdowner.Markdown(),
+			StatusCode: 200,
+			Headers:    map[string]string{"Content-Type": "text/markdown"},
+		}, nil
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return handleError(err, "failed to marshal the report", 500)
+	}
+	return events.APIGatewayProxyResponse{
+		Body:       string(body),
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/data-preservation-programs/singularity-metrics/handler/report"
+)
+
+func main() {
+	lambda.Start(report.HandleRequest)
+}
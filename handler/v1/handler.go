@@ -9,7 +9,11 @@ import (
 	"os"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/data-preservation-programs/singularity-metrics/apikey"
+	"github.com/data-preservation-programs/singularity-metrics/ingest"
+	"github.com/data-preservation-programs/singularity-metrics/model"
 	"github.com/data-preservation-programs/singularity-metrics/model/v1model"
+	"github.com/data-preservation-programs/singularity-metrics/ratelimit"
 	"github.com/klauspost/compress/zstd"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
@@ -19,6 +23,7 @@ import (
 
 var decoder *zstd.Decoder
 var client *mongo.Client
+var ingestOptions ingest.Options
 
 func init() {
 	var err error
@@ -30,6 +35,10 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	ingestOptions, err = ingest.OptionsFromEnv()
+	if err != nil {
+		panic(err)
+	}
 }
 
 func handleError(err error, msg string, status int) (events.APIGatewayProxyResponse, error) {
@@ -39,6 +48,14 @@ func handleError(err error, msg string, status int) (events.APIGatewayProxyRespo
 }
 
 func HandleRequest(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayProxyResponse, error) {
+	apiKey, err := apikey.Authenticate(ctx, client.Database("singularity"), ingestOptions.Auth, request.Headers, true)
+	if apikey.IsUnauthorized(err) {
+		return handleError(err, "failed to authenticate the request", 401)
+	}
+	if err != nil {
+		return handleError(err, "failed to authenticate the request", 500)
+	}
+
 	// Decode the request body with base64
 	decoded, err := base64.StdEncoding.DecodeString(request.Body)
 	if err != nil {
@@ -56,8 +73,8 @@ func HandleRequest(ctx context.Context, request events.APIGatewayV2HTTPRequest)
 	}
 
 	log.Printf("Received %d events\n", len(v1Events))
-	var cars []any
-	var deals []any
+	var cars []model.Car
+	var deals []model.Deal
 	for _, event := range v1Events {
 		switch event.Type {
 		case "deal_proposed":
@@ -80,18 +97,27 @@ func HandleRequest(ctx context.Context, request events.APIGatewayV2HTTPRequest)
 		}
 	}
 
+	err = ingest.Attribute(apiKey, cars, deals)
+	if err != nil {
+		return handleError(err, "failed to attribute the records", 403)
+	}
+
+	err = ingest.Limit(ctx, client.Database("singularity"), ingestOptions, request.RequestContext.HTTP.SourceIP, cars, deals)
+	if errors.Is(err, ratelimit.ErrLimited) {
+		return handleError(err, "failed to accept the records", 429)
+	}
+	if err != nil {
+		return handleError(err, "failed to apply rate limits", 500)
+	}
+
 	log.Printf("Inserting %d cars and %d deals\n", len(cars), len(deals))
-	if len(cars) > 0 {
-		_, err = client.Database("singularity").Collection("cars").InsertMany(ctx, cars)
-		if err != nil {
-			return handleError(err, "failed to insert piece records", 500)
-		}
+	quarantined, err := ingest.Save(ctx, client.Database("singularity"), ingestOptions, cars, deals)
+	if err != nil {
+		return handleError(err, "failed to save records", 500)
 	}
-	if len(deals) > 0 {
-		_, err = client.Database("singularity").Collection("deals").InsertMany(ctx, deals)
-		if err != nil {
-			return handleError(err, "failed to insert deal records", 500)
-		}
+	if quarantined {
+		log.Printf("Quarantined %d cars and %d deals\n", len(cars), len(deals))
+		return events.APIGatewayProxyResponse{Body: fmt.Sprintf("Quarantined %d cars and %d deals for review", len(cars), len(deals)), StatusCode: 202}, nil
 	}
 	return events.APIGatewayProxyResponse{Body: fmt.Sprintf("Inserted %d cars and %d deals", len(cars), len(deals)), StatusCode: 200}, nil
 }
@@ -10,7 +10,10 @@ import (
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
+	"github.com/data-preservation-programs/singularity-metrics/apikey"
+	"github.com/data-preservation-programs/singularity-metrics/ingest"
 	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/data-preservation-programs/singularity-metrics/ratelimit"
 	"github.com/data-preservation-programs/singularity/analytics"
 	"github.com/fxamacker/cbor/v2"
 	"github.com/gotidy/ptr"
@@ -23,6 +26,7 @@ import (
 
 var decoder *zstd.Decoder
 var client *mongo.Client
+var ingestOptions ingest.Options
 
 func init() {
 	var err error
@@ -34,6 +38,10 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	ingestOptions, err = ingest.OptionsFromEnv()
+	if err != nil {
+		panic(err)
+	}
 }
 
 func handleError(err error, msg string, status int) (events.APIGatewayProxyResponse, error) {
@@ -42,6 +50,8 @@ func handleError(err error, msg string, status int) (events.APIGatewayProxyRespo
 	return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: status}, nil
 }
 
+// ToCar converts a pack job event. The event does not identify the dataset of the car, so v2 cars are not part of
+// the datasets.
 func ToCar(event analytics.PackJobEvent, ip string) model.Car {
 	var outputType *string
 	if event.OutputType != "" {
@@ -89,6 +99,14 @@ func ToDeal(event analytics.DealProposalEvent, ip string) model.Deal {
 }
 
 func HandleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	apiKey, err := apikey.Authenticate(ctx, client.Database("singularity"), ingestOptions.Auth, request.Headers, false)
+	if apikey.IsUnauthorized(err) {
+		return handleError(err, "failed to authenticate the request", 401)
+	}
+	if err != nil {
+		return handleError(err, "failed to authenticate the request", 500)
+	}
+
 	// Decode the request body with base64
 	decoded, err := base64.StdEncoding.DecodeString(request.Body)
 	if err != nil {
@@ -108,25 +126,34 @@ func HandleRequest(ctx context.Context, request events.APIGatewayProxyRequest) (
 
 	log.Printf("Received %d pack v2events and %d deal v2events\n", len(v2events.PackJobEvents), len(v2events.DealEvents))
 
-	cars := underscore.Map(v2events.PackJobEvents, func(event analytics.PackJobEvent) any {
+	cars := underscore.Map(v2events.PackJobEvents, func(event analytics.PackJobEvent) model.Car {
 		return ToCar(event, request.RequestContext.Identity.SourceIP)
 	})
-	deals := underscore.Map(v2events.DealEvents, func(event analytics.DealProposalEvent) any {
+	deals := underscore.Map(v2events.DealEvents, func(event analytics.DealProposalEvent) model.Deal {
 		return ToDeal(event, request.RequestContext.Identity.SourceIP)
 	})
 
+	err = ingest.Attribute(apiKey, cars, deals)
+	if err != nil {
+		return handleError(err, "failed to attribute the records", 403)
+	}
+
+	err = ingest.Limit(ctx, client.Database("singularity"), ingestOptions, request.RequestContext.Identity.SourceIP, cars, deals)
+	if errors.Is(err, ratelimit.ErrLimited) {
+		return handleError(err, "failed to accept the records", 429)
+	}
+	if err != nil {
+		return handleError(err, "failed to apply rate limits", 500)
+	}
+
 	log.Printf("Inserting %d cars and %d deals\n", len(cars), len(deals))
-	if len(cars) > 0 {
-		_, err = client.Database("singularity").Collection("cars").InsertMany(ctx, cars)
-		if err != nil {
-			return handleError(err, "failed to insert piece records", 500)
-		}
-	}
-	if len(deals) > 0 {
-		_, err = client.Database("singularity").Collection("deals").InsertMany(ctx, deals)
-		if err != nil {
-			return handleError(err, "failed to insert deal records", 500)
-		}
+	quarantined, err := ingest.Save(ctx, client.Database("singularity"), ingestOptions, cars, deals)
+	if err != nil {
+		return handleError(err, "failed to save records", 500)
+	}
+	if quarantined {
+		log.Printf("Quarantined %d cars and %d deals\n", len(cars), len(deals))
+		return events.APIGatewayProxyResponse{Body: fmt.Sprintf("Quarantined %d cars and %d deals for review", len(cars), len(deals)), StatusCode: 202}, nil
 	}
 	return events.APIGatewayProxyResponse{Body: fmt.Sprintf("Inserted %d cars and %d deals", len(cars), len(deals)), StatusCode: 200}, nil
 }
@@ -0,0 +1,47 @@
+package ingest
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+)
+
+func isPowerOfTwo(n int64) bool {
+	return n > 0 && n&(n-1) == 0
+}
+
+func checkTime(createdAt time.Time, now time.Time, maxClockSkew time.Duration) []string {
+	if createdAt.After(now.Add(maxClockSkew)) {
+		return []string{fmt.Sprintf("created at %s, in the future", createdAt.Format(time.RFC3339))}
+	}
+	return nil
+}
+
+// checkCar returns the reasons why a car is implausible.
+func checkCar(car model.Car, now time.Time, maxClockSkew time.Duration) []string {
+	reasons := checkTime(car.CreatedAt, now, maxClockSkew)
+	if !isPowerOfTwo(car.PieceSize) {
+		reasons = append(reasons, fmt.Sprintf("piece size %d is not a power of two", car.PieceSize))
+	}
+	if car.FileSize < 0 || car.NumOfFiles < 0 {
+		reasons = append(reasons, "negative file size or number of files")
+	}
+	// Pieces are CAR files padded to a power of two.
+	if car.FileSize > car.PieceSize {
+		reasons = append(reasons, fmt.Sprintf("file size %d exceeds piece size %d", car.FileSize, car.PieceSize))
+	}
+	return reasons
+}
+
+// checkDeal returns the reasons why a deal is implausible.
+func checkDeal(deal model.Deal, now time.Time, maxClockSkew time.Duration) []string {
+	reasons := checkTime(deal.CreatedAt, now, maxClockSkew)
+	if !isPowerOfTwo(deal.PieceSize) {
+		reasons = append(reasons, fmt.Sprintf("piece size %d is not a power of two", deal.PieceSize))
+	}
+	if deal.StartEpoch != nil && deal.EndEpoch != nil && *deal.EndEpoch < *deal.StartEpoch {
+		reasons = append(reasons, "deal ends before it starts")
+	}
+	return reasons
+}
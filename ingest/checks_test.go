@@ -0,0 +1,103 @@
+package ingest
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+)
+
+const maxClockSkew = 5 * time.Minute
+
+var checkNow = time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+
+func epoch(e int32) *int32 {
+	return &e
+}
+
+func TestIsPowerOfTwo(t *testing.T) {
+	for n, expected := range map[int64]bool{
+		-8: false, 0: false, 1: true, 2: true, 3: false, 1 << 20: true, 1<<35 + 1: false, 1 << 35: true,
+	} {
+		if isPowerOfTwo(n) != expected {
+			t.Errorf("isPowerOfTwo(%d) = %t", n, !expected)
+		}
+	}
+}
+
+func TestCheckCar(t *testing.T) {
+	valid := model.Car{CreatedAt: checkNow, PieceSize: 1 << 35, FileSize: 30 << 30, NumOfFiles: 10}
+	tests := []struct {
+		name    string
+		change  func(car *model.Car)
+		reasons []string
+	}{
+		{"valid", func(car *model.Car) {}, nil},
+		{"within clock skew", func(car *model.Car) { car.CreatedAt = checkNow.Add(maxClockSkew) }, nil},
+		{"file size equal to piece size", func(car *model.Car) { car.FileSize = car.PieceSize }, nil},
+		{"in the future", func(car *model.Car) { car.CreatedAt = checkNow.Add(time.Hour) },
+			[]string{"created at 2023-08-01T13:00:00Z, in the future"}},
+		{"piece size not a power of two", func(car *model.Car) { car.PieceSize = 3 << 34 },
+			[]string{"piece size 51539607552 is not a power of two"}},
+		{"zero piece size", func(car *model.Car) { car.PieceSize, car.FileSize = 0, 0 },
+			[]string{"piece size 0 is not a power of two"}},
+		{"file size over piece size", func(car *model.Car) { car.FileSize = car.PieceSize + 1 },
+			[]string{"file size 34359738369 exceeds piece size 34359738368"}},
+		{"negative file size", func(car *model.Car) { car.FileSize = -1 },
+			[]string{"negative file size or number of files"}},
+		{"negative number of files", func(car *model.Car) { car.NumOfFiles = -1 },
+			[]string{"negative file size or number of files"}},
+		{"several reasons", func(car *model.Car) {
+			car.CreatedAt = checkNow.Add(24 * time.Hour)
+			car.PieceSize = 1000
+		}, []string{
+			"created at 2023-08-02T12:00:00Z, in the future",
+			"piece size 1000 is not a power of two",
+			"file size 32212254720 exceeds piece size 1000",
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			car := valid
+			test.change(&car)
+			reasons := checkCar(car, checkNow, maxClockSkew)
+			if !reflect.DeepEqual(reasons, test.reasons) {
+				t.Fatalf("checkCar = %q, expected %q", reasons, test.reasons)
+			}
+		})
+	}
+}
+
+func TestCheckDeal(t *testing.T) {
+	valid := model.Deal{CreatedAt: checkNow, PieceSize: 1 << 35, StartEpoch: epoch(3000000), EndEpoch: epoch(4500000)}
+	tests := []struct {
+		name    string
+		change  func(deal *model.Deal)
+		reasons []string
+	}{
+		{"valid", func(deal *model.Deal) {}, nil},
+		{"proposal without epochs", func(deal *model.Deal) { deal.StartEpoch, deal.EndEpoch = nil, nil }, nil},
+		{"in the past", func(deal *model.Deal) { deal.CreatedAt = checkNow.AddDate(-1, 0, 0) }, nil},
+		{"in the future", func(deal *model.Deal) { deal.CreatedAt = checkNow.Add(maxClockSkew + time.Second) },
+			[]string{"created at 2023-08-01T12:05:01Z, in the future"}},
+		{"piece size not a power of two", func(deal *model.Deal) { deal.PieceSize = 1<<35 - 1 },
+			[]string{"piece size 34359738367 is not a power of two"}},
+		{"negative piece size", func(deal *model.Deal) { deal.PieceSize = -(1 << 35) },
+			[]string{"piece size -34359738368 is not a power of two"}},
+		{"ends before it starts", func(deal *model.Deal) { deal.EndEpoch = epoch(2999999) },
+			[]string{"deal ends before it starts"}},
+		{"ends when it starts", func(deal *model.Deal) { deal.EndEpoch = epoch(3000000) }, nil},
+		{"only start epoch", func(deal *model.Deal) { deal.EndEpoch = nil }, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			deal := valid
+			test.change(&deal)
+			reasons := checkDeal(deal, checkNow, maxClockSkew)
+			if !reflect.DeepEqual(reasons, test.reasons) {
+				t.Fatalf("checkDeal = %q, expected %q", reasons, test.reasons)
+			}
+		})
+	}
+}
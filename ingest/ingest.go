@@ -0,0 +1,159 @@
+package ingest
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/apikey"
+	"github.com/data-preservation-programs/singularity-metrics/dataset"
+	"github.com/data-preservation-programs/singularity-metrics/geoip"
+	"github.com/data-preservation-programs/singularity-metrics/instance"
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/data-preservation-programs/singularity-metrics/ratelimit"
+	"github.com/data-preservation-programs/singularity-metrics/retention"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Options control how reported records are processed before they are stored.
+type Options struct {
+	IPPolicy retention.Policy
+	// Geo enriches reporters with the location of their IP if set.
+	Geo    *geoip.Resolver
+	Auth   apikey.Policy
+	Limits ratelimit.Limits
+	// MaxClockSkew is how far in the future records can be created before they are quarantined.
+	MaxClockSkew time.Duration
+}
+
+// OptionsFromEnv reads the options from the environment of the handlers.
+func OptionsFromEnv() (Options, error) {
+	policy, err := retention.PolicyFromEnv()
+	if err != nil {
+		return Options{}, errors.Wrap(err, "invalid IP retention policy")
+	}
+	auth, err := apikey.PolicyFromEnv()
+	if err != nil {
+		return Options{}, errors.Wrap(err, "invalid API key policy")
+	}
+	limits, err := ratelimit.LimitsFromEnv()
+	if err != nil {
+		return Options{}, err
+	}
+	maxClockSkew := time.Hour
+	if value := os.Getenv("MAX_CLOCK_SKEW"); value != "" {
+		maxClockSkew, err = time.ParseDuration(value)
+		if err != nil {
+			return Options{}, errors.Wrap(err, "invalid MAX_CLOCK_SKEW")
+		}
+	}
+	resolver, err := geoip.OpenFromEnv()
+	if err != nil {
+		return Options{}, err
+	}
+	return Options{IPPolicy: policy, Geo: resolver, Auth: auth, Limits: limits, MaxClockSkew: maxClockSkew}, nil
+}
+
+// Attribute attributes the records to the identity of the API key they were sent with, if any.
+func Attribute(apiKey *model.APIKey, cars []model.Car, deals []model.Deal) error {
+	for i := range cars {
+		if err := apikey.Attribute(apiKey, &cars[i].Reporter); err != nil {
+			return err
+		}
+	}
+	for i := range deals {
+		if err := apikey.Attribute(apiKey, &deals[i].Reporter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepare enriches the reporter before its IP is truncated, so that the location is resolved from the full IP.
+func (o Options) prepare(reporter *model.Reporter) {
+	if o.Geo != nil && reporter.Geo == nil {
+		reporter.Geo = o.Geo.Lookup(reporter.IP)
+	}
+	if o.IPPolicy.AtIngestion {
+		o.IPPolicy.TruncateReporter(reporter)
+	}
+}
+
+// Limit takes the records of a request from the rate limits of its source IP and of the instances it reports for.
+// It returns an error wrapping ratelimit.ErrLimited if a limit is exceeded.
+func Limit(ctx context.Context, db *mongo.Database, opts Options, ip string, cars []model.Car, deals []model.Deal) error {
+	recordsByInstance := make(map[string]int)
+	for _, car := range cars {
+		recordsByInstance[car.InstanceID]++
+	}
+	for _, deal := range deals {
+		recordsByInstance[deal.InstanceID]++
+	}
+	return ratelimit.Allow(ctx, db, opts.Limits, ip, recordsByInstance)
+}
+
+// Save stores the cars and deals reported by a Singularity instance and updates the records derived from them.
+// If any record fails the sanity checks, the whole batch is quarantined for review instead, and Save returns true.
+func Save(ctx context.Context, db *mongo.Database, opts Options, cars []model.Car, deals []model.Deal) (bool, error) {
+	for i := range cars {
+		opts.prepare(&cars[i].Reporter)
+	}
+	for i := range deals {
+		opts.prepare(&deals[i].Reporter)
+	}
+	now := time.Now().UTC()
+	carReasons := make([][]string, len(cars))
+	dealReasons := make([][]string, len(deals))
+	flagged := false
+	for i, car := range cars {
+		carReasons[i] = checkCar(car, now, opts.MaxClockSkew)
+		flagged = flagged || len(carReasons[i]) > 0
+	}
+	for i, deal := range deals {
+		dealReasons[i] = checkDeal(deal, now, opts.MaxClockSkew)
+		flagged = flagged || len(dealReasons[i]) > 0
+	}
+	if flagged {
+		return true, quarantine(ctx, db, cars, carReasons, deals, dealReasons, now)
+	}
+	return false, store(ctx, db, cars, deals, now)
+}
+
+// store inserts records that passed the checks. The datasets and the instance registry are derived from the
+// records, so failing to update them is only logged: failing the request would make the client send the records
+// again, and the next dataset refresh and instance rebuild repair them.
+func store(ctx context.Context, db *mongo.Database, cars []model.Car, deals []model.Deal, now time.Time) error {
+	if len(cars) > 0 {
+		docs := make([]any, 0, len(cars))
+		for _, car := range cars {
+			docs = append(docs, car)
+		}
+		_, err := db.Collection("cars").InsertMany(ctx, docs)
+		if err != nil {
+			return errors.Wrap(err, "failed to insert piece records")
+		}
+	}
+	if len(deals) > 0 {
+		docs := make([]any, 0, len(deals))
+		for _, deal := range deals {
+			docs = append(docs, deal)
+		}
+		_, err := db.Collection("deals").InsertMany(ctx, docs)
+		if err != nil {
+			return errors.Wrap(err, "failed to insert deal records")
+		}
+	}
+	if len(cars) > 0 {
+		err := dataset.Record(ctx, db, cars)
+		if err != nil {
+			log.Printf("failed to update datasets: %s\n", err)
+		}
+	}
+	err := instance.Record(ctx, db, cars, deals, now)
+	if err != nil {
+		log.Printf("failed to update instances: %s\n", err)
+	}
+	return nil
+}
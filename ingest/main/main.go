@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/ingest"
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// withDatabase connects to the metrics database for the duration of a command.
+func withDatabase(c *cli.Context, f func(db *mongo.Database) error) error {
+	mg, err := mongo.Connect(c.Context, options.Client().ApplyURI(c.String("mongodb-uri")))
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to mongo")
+	}
+	defer func() {
+		_ = mg.Disconnect(context.Background())
+	}()
+	return f(mg.Database("singularity"))
+}
+
+func batchID(c *cli.Context) (primitive.ObjectID, error) {
+	if c.Args().Len() != 1 {
+		return primitive.NilObjectID, errors.New("expected the ID of a quarantined batch")
+	}
+	id, err := primitive.ObjectIDFromHex(c.Args().First())
+	return id, errors.Wrap(err, "invalid batch ID")
+}
+
+func list(c *cli.Context) error {
+	return withDatabase(c, func(db *mongo.Database) error {
+		batches, err := ingest.QuarantineBatches(c.Context, db)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "BATCH\tQUARANTINED AT\tINSTANCES\tIPS\tCARS\tDEALS\tREASONS")
+		for _, b := range batches {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", b.BatchID.Hex(), b.QuarantinedAt.Format(time.RFC3339),
+				strings.Join(b.InstanceIDs, ","), strings.Join(b.IPs, ","), b.Cars, b.Deals, strings.Join(b.Reasons, "; "))
+		}
+		return errors.Wrap(tw.Flush(), "failed to write quarantined batches")
+	})
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app := &cli.App{
+		Name:  "ingest",
+		Usage: "Review the reports held back from the metrics database",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "mongodb-uri",
+				Usage:   "MongoDB connection string",
+				EnvVars: []string{"MONGODB_URI"},
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "quarantine",
+				Usage: "Review the batches that failed the sanity checks",
+				Subcommands: []*cli.Command{
+					{
+						Name:   "list",
+						Usage:  "List the quarantined batches and why they were quarantined",
+						Action: list,
+					},
+					{
+						Name:      "release",
+						Usage:     "Store the records of a batch that turned out to be genuine",
+						ArgsUsage: "<batch>",
+						Action: func(c *cli.Context) error {
+							id, err := batchID(c)
+							if err != nil {
+								return err
+							}
+							return withDatabase(c, func(db *mongo.Database) error {
+								cars, deals, err := ingest.Release(c.Context, db, id)
+								if err != nil {
+									return err
+								}
+								fmt.Printf("released %d cars and %d deals\n", cars, deals)
+								return nil
+							})
+						},
+					},
+					{
+						Name:      "discard",
+						Usage:     "Delete the records of a batch",
+						ArgsUsage: "<batch>",
+						Action: func(c *cli.Context) error {
+							id, err := batchID(c)
+							if err != nil {
+								return err
+							}
+							return withDatabase(c, func(db *mongo.Database) error {
+								n, err := ingest.Discard(c.Context, db, id)
+								if err != nil {
+									return err
+								}
+								fmt.Printf("discarded %d records\n", n)
+								return nil
+							})
+						},
+					},
+				},
+			},
+		},
+	}
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,134 @@
+package ingest
+
+import (
+	"context"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// QuarantineCollection holds the records of the batches that failed the sanity checks. Records keep the fields of
+// their car or deal at the top level, so that IP retention and purges apply to them like to the main collections.
+const QuarantineCollection = "quarantine"
+
+type quarantinedCar struct {
+	model.Car  `bson:",inline"`
+	Quarantine model.Quarantine `bson:"quarantine"`
+}
+
+type quarantinedDeal struct {
+	model.Deal `bson:",inline"`
+	Quarantine model.Quarantine `bson:"quarantine"`
+}
+
+func quarantine(ctx context.Context, db *mongo.Database, cars []model.Car, carReasons [][]string,
+	deals []model.Deal, dealReasons [][]string, now time.Time) error {
+	batchID := primitive.NewObjectID()
+	docs := make([]any, 0, len(cars)+len(deals))
+	for i, car := range cars {
+		docs = append(docs, quarantinedCar{Car: car, Quarantine: model.Quarantine{
+			BatchID: batchID, Kind: "car", Reasons: carReasons[i], QuarantinedAt: now,
+		}})
+	}
+	for i, deal := range deals {
+		docs = append(docs, quarantinedDeal{Deal: deal, Quarantine: model.Quarantine{
+			BatchID: batchID, Kind: "deal", Reasons: dealReasons[i], QuarantinedAt: now,
+		}})
+	}
+	_, err := db.Collection(QuarantineCollection).InsertMany(ctx, docs)
+	return errors.Wrap(err, "failed to quarantine records")
+}
+
+// QuarantineBatches summarizes the quarantined batches, newest first.
+func QuarantineBatches(ctx context.Context, db *mongo.Database) ([]model.QuarantineBatch, error) {
+	cursor, err := db.Collection(QuarantineCollection).Aggregate(ctx, bson.A{
+		bson.M{"$group": bson.M{
+			"_id":           "$quarantine.batchId",
+			"quarantinedAt": bson.M{"$min": "$quarantine.quarantinedAt"},
+			"instanceIds":   bson.M{"$addToSet": "$instanceId"},
+			"ips":           bson.M{"$addToSet": "$ip"},
+			"cars":          bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$quarantine.kind", "car"}}, 1, 0}}},
+			"deals":         bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$quarantine.kind", "deal"}}, 1, 0}}},
+			"reasons":       bson.M{"$push": bson.M{"$ifNull": bson.A{"$quarantine.reasons", bson.A{}}}},
+		}},
+		bson.M{"$set": bson.M{"reasons": bson.M{"$reduce": bson.M{
+			"input":        "$reasons",
+			"initialValue": bson.A{},
+			"in":           bson.M{"$setUnion": bson.A{"$$value", "$$this"}},
+		}}}},
+		bson.M{"$sort": bson.M{"quarantinedAt": -1}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to aggregate quarantined records")
+	}
+	var batches []model.QuarantineBatch
+	err = cursor.All(ctx, &batches)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode quarantined batches")
+	}
+	return batches, nil
+}
+
+// Release stores the records of a quarantined batch after review, as if they had passed the checks,
+// and removes them from the quarantine. It returns the number of cars and deals released.
+func Release(ctx context.Context, db *mongo.Database, batchID primitive.ObjectID) (int, int, error) {
+	cursor, err := db.Collection(QuarantineCollection).Find(ctx, bson.M{"quarantine.batchId": batchID})
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to query quarantined records")
+	}
+	defer cursor.Close(ctx)
+	var cars []model.Car
+	var deals []model.Deal
+	for cursor.Next(ctx) {
+		var kind struct {
+			Quarantine model.Quarantine `bson:"quarantine"`
+		}
+		err = cursor.Decode(&kind)
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "failed to decode quarantined record")
+		}
+		switch kind.Quarantine.Kind {
+		case "car":
+			var car quarantinedCar
+			err = cursor.Decode(&car)
+			cars = append(cars, car.Car)
+		case "deal":
+			var deal quarantinedDeal
+			err = cursor.Decode(&deal)
+			deals = append(deals, deal.Deal)
+		default:
+			err = errors.Errorf("unknown quarantined record kind %q", kind.Quarantine.Kind)
+		}
+		if err != nil {
+			return 0, 0, errors.Wrap(err, "failed to decode quarantined record")
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return 0, 0, errors.Wrap(err, "failed to iterate quarantined records")
+	}
+	if len(cars) == 0 && len(deals) == 0 {
+		return 0, 0, errors.Errorf("quarantined batch %s not found", batchID.Hex())
+	}
+	err = store(ctx, db, cars, deals, time.Now().UTC())
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = db.Collection(QuarantineCollection).DeleteMany(ctx, bson.M{"quarantine.batchId": batchID})
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "failed to remove released records from the quarantine")
+	}
+	return len(cars), len(deals), nil
+}
+
+// Discard deletes the records of a quarantined batch and returns how many were deleted.
+func Discard(ctx context.Context, db *mongo.Database, batchID primitive.ObjectID) (int64, error) {
+	result, err := db.Collection(QuarantineCollection).DeleteMany(ctx, bson.M{"quarantine.batchId": batchID})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to discard quarantined records")
+	}
+	return result.DeletedCount, nil
+}
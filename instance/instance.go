@@ -0,0 +1,236 @@
+package instance
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const Collection = "instances"
+
+type activity struct {
+	reporter    model.Reporter
+	ips         map[string]struct{}
+	cars        int64
+	deals       int64
+	firstSeenAt time.Time
+}
+
+func (a *activity) created(at time.Time) {
+	if a.firstSeenAt.IsZero() || at.Before(a.firstSeenAt) {
+		a.firstSeenAt = at
+	}
+}
+
+// skipped reports whether records of the instance are left out of the registry: records without an instance ID, and
+// deals found on chain, which are stored under the "external" instance.
+func skipped(instanceID string) bool {
+	return instanceID == "" || instanceID == "external"
+}
+
+// Record updates the instances that reported the given cars and deals at the given ingestion time. An instance is
+// first seen at the earliest creation time of its records, which clients report themselves, and last seen when they
+// were ingested.
+func Record(ctx context.Context, db *mongo.Database, cars []model.Car, deals []model.Deal, at time.Time) error {
+	instances := make(map[string]*activity)
+	get := func(reporter model.Reporter) *activity {
+		a, ok := instances[reporter.InstanceID]
+		if !ok {
+			a = &activity{reporter: reporter, ips: make(map[string]struct{})}
+			instances[reporter.InstanceID] = a
+		}
+		if reporter.IP != "" {
+			a.ips[reporter.IP] = struct{}{}
+		}
+		if reporter.Identity != "" {
+			a.reporter.Identity = reporter.Identity
+		}
+		return a
+	}
+	for _, car := range cars {
+		if skipped(car.InstanceID) {
+			continue
+		}
+		a := get(car.Reporter)
+		a.cars++
+		a.created(car.CreatedAt)
+	}
+	for _, deal := range deals {
+		if skipped(deal.InstanceID) {
+			continue
+		}
+		a := get(deal.Reporter)
+		a.deals++
+		a.created(deal.CreatedAt)
+	}
+	for id, a := range instances {
+		ips := make(bson.A, 0, len(a.ips))
+		for ip := range a.ips {
+			ips = append(ips, ip)
+		}
+		set := bson.M{"isV1": a.reporter.IsV1}
+		if a.reporter.Identity != "" {
+			set["identity"] = a.reporter.Identity
+		}
+		_, err := db.Collection(Collection).UpdateOne(ctx, bson.M{"_id": id}, bson.M{
+			"$set":      set,
+			"$min":      bson.M{"firstSeenAt": a.firstSeenAt},
+			"$max":      bson.M{"lastSeenAt": at},
+			"$inc":      bson.M{"cars": a.cars, "deals": a.deals},
+			"$addToSet": bson.M{"ips": bson.M{"$each": ips}},
+		}, options.Update().SetUpsert(true))
+		if err != nil {
+			return errors.Wrap(err, "failed to update instance")
+		}
+	}
+	return nil
+}
+
+// countByInstance aggregates the documents of a collection by the instance that reported them, skipping the records
+// Record skips. The ingestion times are not stored, so an instance is last seen at the latest creation time.
+func countByInstance(ctx context.Context, db *mongo.Database, collection string) ([]model.Instance, error) {
+	cursor, err := db.Collection(collection).Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"instanceId": bson.M{"$nin": bson.A{nil, "", "external"}}}},
+		bson.M{"$sort": bson.M{"createdAt": 1}},
+		bson.M{"$group": bson.M{
+			"_id":         "$instanceId",
+			"isV1":        bson.M{"$last": "$isV1"},
+			"identity":    bson.M{"$last": "$identity"},
+			"ips":         bson.M{"$addToSet": "$ip"},
+			"firstSeenAt": bson.M{"$min": "$createdAt"},
+			"lastSeenAt":  bson.M{"$max": "$createdAt"},
+			"count":       bson.M{"$sum": 1},
+		}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to aggregate %s", collection)
+	}
+	defer cursor.Close(ctx)
+	var rows []struct {
+		model.Instance `bson:",inline"`
+		Count          int64 `bson:"count"`
+	}
+	err = cursor.All(ctx, &rows)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", collection)
+	}
+	instances := make([]model.Instance, 0, len(rows))
+	for _, row := range rows {
+		i := row.Instance
+		if collection == "cars" {
+			i.Cars = row.Count
+		} else {
+			i.Deals = row.Count
+		}
+		instances = append(instances, i)
+	}
+	return instances, nil
+}
+
+// Rebuild recomputes every instance from the cars and deals it has reported.
+func Rebuild(ctx context.Context, db *mongo.Database) (int, error) {
+	instances := make(map[string]*model.Instance)
+	for _, collection := range []string{"cars", "deals"} {
+		rows, err := countByInstance(ctx, db, collection)
+		if err != nil {
+			return 0, err
+		}
+		for _, row := range rows {
+			i, ok := instances[row.InstanceID]
+			if !ok {
+				row := row
+				instances[row.InstanceID] = &row
+				continue
+			}
+			i.Cars += row.Cars
+			i.Deals += row.Deals
+			if row.Identity != "" && row.LastSeenAt.After(i.LastSeenAt) {
+				i.Identity = row.Identity
+			}
+			if row.FirstSeenAt.Before(i.FirstSeenAt) {
+				i.FirstSeenAt = row.FirstSeenAt
+			}
+			if row.LastSeenAt.After(i.LastSeenAt) {
+				i.LastSeenAt = row.LastSeenAt
+			}
+			for _, ip := range row.IPs {
+				if !contains(i.IPs, ip) {
+					i.IPs = append(i.IPs, ip)
+				}
+			}
+		}
+	}
+	// Earlier rebuilds registered the external instance.
+	_, err := db.Collection(Collection).DeleteOne(ctx, bson.M{"_id": "external"})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to remove the external instance")
+	}
+	for id, i := range instances {
+		_, err := db.Collection(Collection).ReplaceOne(ctx, bson.M{"_id": id}, i, options.Replace().SetUpsert(true))
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to save instance")
+		}
+	}
+	log.Printf("rebuilt %d instances\n", len(instances))
+	return len(instances), nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type Filter struct {
+	// IsV1 selects v1 or v2 instances only if set.
+	IsV1     *bool
+	Identity string
+	IP       string
+	// SeenSince and QuietSince select instances last seen after or before the given time if set.
+	SeenSince  time.Time
+	QuietSince time.Time
+}
+
+// List returns the instances matching the filter, most recently seen first.
+func List(ctx context.Context, db *mongo.Database, filter Filter) ([]model.Instance, error) {
+	query := bson.M{}
+	if filter.IsV1 != nil {
+		query["isV1"] = *filter.IsV1
+	}
+	if filter.Identity != "" {
+		query["identity"] = filter.Identity
+	}
+	if filter.IP != "" {
+		query["ips"] = filter.IP
+	}
+	lastSeenAt := bson.M{}
+	if !filter.SeenSince.IsZero() {
+		lastSeenAt["$gte"] = filter.SeenSince
+	}
+	if !filter.QuietSince.IsZero() {
+		lastSeenAt["$lt"] = filter.QuietSince
+	}
+	if len(lastSeenAt) > 0 {
+		query["lastSeenAt"] = lastSeenAt
+	}
+	cursor, err := db.Collection(Collection).Find(ctx, query, options.Find().SetSort(bson.M{"lastSeenAt": -1}))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get instances")
+	}
+	defer cursor.Close(ctx)
+	var instances []model.Instance
+	err = cursor.All(ctx, &instances)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode instances")
+	}
+	return instances, nil
+}
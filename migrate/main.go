@@ -2,95 +2,76 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/data-preservation-programs/singularity-metrics/model/v1model"
 	"github.com/jackc/pgx/v5"
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type Event struct {
-	Type      string `db:"type"`
-	Timestamp int64  `db:"timestamp"`
-	IP        string `db:"ip"`
-	Instance  string `db:"instance"`
-	Values    string `db:"values"`
-}
-
-func main() {
-	ctx := context.Background()
-	db, err := pgx.Connect(ctx, os.Getenv("DATABASE_URL"))
+func migrateAction(c *cli.Context) error {
+	ctx := c.Context
+	db, err := pgx.Connect(ctx, c.String("database-url"))
 	if err != nil {
-		panic(err)
+		return errors.Wrap(err, "failed to connect to postgres")
 	}
-	mg, err := mongo.Connect(context.Background(), options.Client().ApplyURI(os.Getenv("MONGODB_URI")))
+	defer db.Close(context.Background())
+	mg, err := mongo.Connect(ctx, options.Client().ApplyURI(c.String("mongodb-uri")))
 	if err != nil {
-		panic(err)
+		return errors.Wrap(err, "failed to connect to mongo")
 	}
-	defer db.Close(ctx)
+	defer func() {
+		_ = mg.Disconnect(context.Background())
+	}()
 
-	query, err := db.Query(ctx, "SELECT type, timestamp, ip, instance, values FROM events WHERE type = 'deal_proposed'")
-	if err != nil {
-		panic(err)
+	opts := migrateOptions{
+		Name:      c.String("name"),
+		Column:    c.String("checkpoint-column"),
+		Types:     c.StringSlice("type"),
+		BatchSize: c.Int("batch-size"),
+		Restart:   c.Bool("restart"),
 	}
-
-	var events []Event
-
-	for query.Next() {
-		var event Event
-		err = query.Scan(&event.Type, &event.Timestamp, &event.IP, &event.Instance, &event.Values)
-		if err != nil {
-			panic(err)
-		}
-		events = append(events, event)
-		if len(events) == 10000 {
-			save(ctx, mg, events)
-			if err != nil {
-				panic(err)
-			}
-			events = []Event{}
-		}
+	if t := c.Timestamp("from"); t != nil {
+		opts.From = *t
 	}
-
-	save(ctx, mg, events)
+	if t := c.Timestamp("to"); t != nil {
+		opts.To = *t
+	}
+	m := &migration{pg: db, db: mg.Database("singularity"), opts: opts}
+	return m.run(ctx)
 }
 
-func save(ctx context.Context, client *mongo.Client, events []Event) {
-	var cars []any
-	var deals []any
-	for _, event := range events {
-		switch event.Type {
-		case "generation_complete":
-			var e v1model.GenerationCompleteEvent
-			err := json.Unmarshal([]byte(event.Values), &e)
-			if err != nil {
-				panic(err)
-			}
-			cars = append(cars, e.ToCar(event.Timestamp, event.Instance, event.IP))
-		case "deal_proposed":
-			var e v1model.DealProposalEvent
-			err := json.Unmarshal([]byte(event.Values), &e)
-			if err != nil {
-				panic(err)
-			}
-			deals = append(deals, e.ToDeal(event.Timestamp, event.Instance, event.IP))
-		}
-	}
-	log.Printf("Inserting %d cars and %d deals\n", len(cars), len(deals))
-	if len(cars) > 0 {
-		_, err := client.Database("singularity").Collection("cars").InsertMany(ctx, cars)
-		if err != nil {
-			panic(err)
-		}
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app := &cli.App{
+		Name: "migrate",
+		Usage: "Migrate v1 events from Postgres to MongoDB. The migration can be interrupted and resumed, " +
+			"and events migrated before are not inserted again. Refresh the datasets and rebuild the instances afterwards.",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "database-url", Usage: "Postgres connection string", EnvVars: []string{"DATABASE_URL"}},
+			&cli.StringFlag{Name: "mongodb-uri", Usage: "MongoDB connection string", EnvVars: []string{"MONGODB_URI"}},
+			&cli.StringFlag{Name: "name", Usage: "Name of the checkpoint to resume from and save to", Value: "v1-events"},
+			&cli.StringFlag{
+				Name:  "checkpoint-column",
+				Usage: "Increasing integer column of the events table to order by and checkpoint on, such as the primary key",
+				Value: "timestamp",
+			},
+			&cli.StringSliceFlag{Name: "type", Usage: "Only migrate events of this type, can be repeated"},
+			&cli.TimestampFlag{Name: "from", Usage: "Only migrate events at or after this time", Layout: time.RFC3339},
+			&cli.TimestampFlag{Name: "to", Usage: "Only migrate events before this time", Layout: time.RFC3339},
+			&cli.IntFlag{Name: "batch-size", Usage: "Number of events saved between checkpoints", Value: 10000},
+			&cli.BoolFlag{Name: "restart", Usage: "Ignore the saved checkpoint and start from the beginning"},
+		},
+		Action: migrateAction,
 	}
-	if len(deals) > 0 {
-		_, err := client.Database("singularity").Collection("deals").InsertMany(ctx, deals)
-		if err != nil {
-			panic(err)
-		}
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		panic(err)
 	}
 }
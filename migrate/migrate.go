@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model/v1model"
+	"github.com/data-preservation-programs/singularity-metrics/schema"
+	"github.com/jackc/pgx/v5"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	checkpointsCollection = "migrationCheckpoints"
+	// rawEventsCollection holds the v1 events that are neither cars nor deals.
+	rawEventsCollection = "v1Events"
+)
+
+// columnPattern restricts the checkpoint column, since it is interpolated into the query.
+var columnPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+type Event struct {
+	Type      string `db:"type"`
+	Timestamp int64  `db:"timestamp"`
+	IP        string `db:"ip"`
+	Instance  string `db:"instance"`
+	Values    string `db:"values"`
+	// position is the value of the checkpoint column.
+	position int64
+}
+
+// Fingerprint identifies the event by its content, so that migrating it again finds the record saved before.
+func (e Event) Fingerprint() string {
+	h := sha256.New()
+	for _, field := range []string{e.Type, strconv.FormatInt(e.Timestamp, 10), e.Instance, e.IP, e.Values} {
+		h.Write([]byte(field))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type RawEvent struct {
+	Fingerprint string    `bson:"fingerprint"`
+	Type        string    `bson:"type"`
+	CreatedAt   time.Time `bson:"createdAt"`
+	InstanceID  string    `bson:"instanceId"`
+	IP          string    `bson:"ip"`
+	Values      string    `bson:"values"`
+}
+
+type migrateOptions struct {
+	// Name identifies the checkpoint of the migration.
+	Name string
+	// Column is an integer column of the events table that only grows, such as the primary key or the timestamp.
+	Column    string
+	Types     []string
+	From      time.Time
+	To        time.Time
+	BatchSize int
+	Restart   bool
+}
+
+// checkpoint records how far a migration got, along with the filters it was started with.
+type checkpoint struct {
+	Name        string     `bson:"_id"`
+	Column      string     `bson:"column"`
+	Types       []string   `bson:"types"`
+	From        time.Time  `bson:"from"`
+	To          time.Time  `bson:"to"`
+	Position    int64      `bson:"position"`
+	Migrated    int64      `bson:"migrated"`
+	Skipped     int64      `bson:"skipped"`
+	UpdatedAt   time.Time  `bson:"updatedAt"`
+	CompletedAt *time.Time `bson:"completedAt,omitempty"`
+}
+
+func (c checkpoint) sameFilters(opts migrateOptions) bool {
+	return c.Column == opts.Column &&
+		strings.Join(c.Types, ",") == strings.Join(opts.Types, ",") &&
+		c.From.Equal(opts.From) && c.To.Equal(opts.To)
+}
+
+type migration struct {
+	pg         *pgx.Conn
+	db         *mongo.Database
+	opts       migrateOptions
+	checkpoint checkpoint
+}
+
+// loadCheckpoint resumes the migration from its checkpoint, unless it is restarted.
+func (m *migration) loadCheckpoint(ctx context.Context) error {
+	m.checkpoint = checkpoint{
+		Name:     m.opts.Name,
+		Column:   m.opts.Column,
+		Types:    m.opts.Types,
+		From:     m.opts.From,
+		To:       m.opts.To,
+		Position: math.MinInt64,
+	}
+	if m.opts.Restart {
+		return nil
+	}
+	var saved checkpoint
+	err := m.db.Collection(checkpointsCollection).FindOne(ctx, bson.M{"_id": m.opts.Name}).Decode(&saved)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to get checkpoint")
+	}
+	if !saved.sameFilters(m.opts) {
+		return errors.Errorf("checkpoint %s was saved with different filters, use another name or restart", m.opts.Name)
+	}
+	m.checkpoint = saved
+	m.checkpoint.CompletedAt = nil
+	log.Printf("resuming migration %s from %s %d with %d events migrated\n", saved.Name, saved.Column, saved.Position, saved.Migrated)
+	return nil
+}
+
+func (m *migration) saveCheckpoint(ctx context.Context) error {
+	m.checkpoint.UpdatedAt = time.Now().UTC()
+	_, err := m.db.Collection(checkpointsCollection).ReplaceOne(ctx, bson.M{"_id": m.checkpoint.Name}, m.checkpoint,
+		options.Replace().SetUpsert(true))
+	return errors.Wrap(err, "failed to save checkpoint")
+}
+
+// where returns the filters of the migration as a SQL condition and its arguments, starting at the checkpoint.
+// Events at the checkpoint position are read again, since the batch may have ended in the middle of them.
+func (m *migration) where() (string, []any) {
+	conditions := []string{fmt.Sprintf("%s >= $1", m.opts.Column)}
+	args := []any{m.checkpoint.Position}
+	if len(m.opts.Types) > 0 {
+		args = append(args, m.opts.Types)
+		conditions = append(conditions, fmt.Sprintf("type = ANY($%d)", len(args)))
+	}
+	if !m.opts.From.IsZero() {
+		args = append(args, m.opts.From.Unix())
+		conditions = append(conditions, fmt.Sprintf("timestamp >= $%d", len(args)))
+	}
+	if !m.opts.To.IsZero() {
+		args = append(args, m.opts.To.Unix())
+		conditions = append(conditions, fmt.Sprintf("timestamp < $%d", len(args)))
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func (m *migration) run(ctx context.Context) error {
+	if !columnPattern.MatchString(m.opts.Column) {
+		return errors.Errorf("invalid checkpoint column %q", m.opts.Column)
+	}
+	if m.opts.BatchSize < 1 {
+		return errors.Errorf("batch size must be positive, got %d", m.opts.BatchSize)
+	}
+	// Reruns find the records of events migrated before through these indexes.
+	err := schema.EnsureIndexes(ctx, m.db, "cars", "deals", rawEventsCollection)
+	if err != nil {
+		return err
+	}
+	err = m.loadCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	where, args := m.where()
+	var remaining int64
+	err = m.pg.QueryRow(ctx, "SELECT count(*) FROM events WHERE "+where, args...).Scan(&remaining)
+	if err != nil {
+		return errors.Wrap(err, "failed to count events")
+	}
+	log.Printf("%d events to migrate\n", remaining)
+
+	rows, err := m.pg.Query(ctx, fmt.Sprintf(
+		"SELECT type, timestamp, ip, instance, values, %s::bigint FROM events WHERE %s ORDER BY %s",
+		m.opts.Column, where, m.opts.Column), args...)
+	if err != nil {
+		return errors.Wrap(err, "failed to query events")
+	}
+	defer rows.Close()
+
+	start := time.Now()
+	var processed int64
+	var events []Event
+	flush := func() error {
+		if len(events) == 0 {
+			return nil
+		}
+		skipped, err := m.save(ctx, events)
+		if err != nil {
+			return err
+		}
+		processed += int64(len(events))
+		m.checkpoint.Position = events[len(events)-1].position
+		m.checkpoint.Migrated += int64(len(events) - skipped)
+		m.checkpoint.Skipped += int64(skipped)
+		err = m.saveCheckpoint(ctx)
+		if err != nil {
+			return err
+		}
+		rate := float64(processed) / time.Since(start).Seconds()
+		log.Printf("migrated %d/%d events (%.1f%%), %.0f events/s, checkpoint %s %d\n",
+			processed, remaining, float64(processed)/math.Max(float64(remaining), 1)*100, rate,
+			m.opts.Column, m.checkpoint.Position)
+		events = events[:0]
+		return nil
+	}
+	for rows.Next() {
+		var event Event
+		err = rows.Scan(&event.Type, &event.Timestamp, &event.IP, &event.Instance, &event.Values, &event.position)
+		if err != nil {
+			return errors.Wrap(err, "failed to scan event")
+		}
+		events = append(events, event)
+		if len(events) >= m.opts.BatchSize {
+			err = flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "failed to read events")
+	}
+	err = flush()
+	if err != nil {
+		return err
+	}
+
+	completedAt := time.Now().UTC()
+	m.checkpoint.CompletedAt = &completedAt
+	err = m.saveCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("migration %s complete: %d events migrated, %d skipped\n", m.checkpoint.Name, m.checkpoint.Migrated, m.checkpoint.Skipped)
+	return nil
+}
+
+// upsert inserts the document unless a record with the same fingerprint exists.
+func upsert(fingerprint string, doc any) mongo.WriteModel {
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"fingerprint": fingerprint}).
+		SetUpdate(bson.M{"$setOnInsert": doc}).
+		SetUpsert(true)
+}
+
+// upsertRecord inserts a car or deal unless a record with the same fingerprint exists. Before fingerprints, the
+// migration and the v1 ingestion stored records without one, so a v1 record without a fingerprint that matches the
+// given fields is taken to be the same event and gets the fingerprint instead. The document must not have a
+// fingerprint set.
+func upsertRecord(fingerprint string, match bson.M, doc any) mongo.WriteModel {
+	legacy := bson.M{"fingerprint": bson.M{"$exists": false}, "isV1": true}
+	for k, v := range match {
+		legacy[k] = v
+	}
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"$or": bson.A{bson.M{"fingerprint": fingerprint}, legacy}}).
+		SetUpdate(bson.M{"$set": bson.M{"fingerprint": fingerprint}, "$setOnInsert": doc}).
+		SetUpsert(true)
+}
+
+// save upserts the events into cars, deals or the raw events, and returns the number of events that could not be
+// decoded and were skipped.
+func (m *migration) save(ctx context.Context, events []Event) (int, error) {
+	writes := make(map[string][]mongo.WriteModel)
+	var skipped int
+	for _, event := range events {
+		fingerprint := event.Fingerprint()
+		switch event.Type {
+		case "generation_complete":
+			var e v1model.GenerationCompleteEvent
+			err := json.Unmarshal([]byte(event.Values), &e)
+			if err != nil {
+				log.Printf("skipping generation_complete event at %s %d: %s\n", m.opts.Column, event.position, err)
+				skipped++
+				continue
+			}
+			car := e.ToCar(event.Timestamp, event.Instance, event.IP)
+			writes["cars"] = append(writes["cars"], upsertRecord(fingerprint, bson.M{
+				"instanceId": car.InstanceID,
+				"createdAt":  car.CreatedAt,
+				"pieceCid":   car.PieceCID,
+			}, car))
+		case "deal_proposed":
+			var e v1model.DealProposalEvent
+			err := json.Unmarshal([]byte(event.Values), &e)
+			if err != nil {
+				log.Printf("skipping deal_proposed event at %s %d: %s\n", m.opts.Column, event.position, err)
+				skipped++
+				continue
+			}
+			deal := e.ToDeal(event.Timestamp, event.Instance, event.IP)
+			writes["deals"] = append(writes["deals"], upsertRecord(fingerprint, bson.M{
+				"instanceId": deal.InstanceID,
+				"createdAt":  deal.CreatedAt,
+				"pieceCid":   deal.PieceCID,
+				"provider":   deal.Provider,
+			}, deal))
+		default:
+			writes[rawEventsCollection] = append(writes[rawEventsCollection], upsert(fingerprint, RawEvent{
+				Fingerprint: fingerprint,
+				Type:        event.Type,
+				CreatedAt:   time.Unix(event.Timestamp, 0),
+				InstanceID:  event.Instance,
+				IP:          event.IP,
+				Values:      event.Values,
+			}))
+		}
+	}
+	for collection, models := range writes {
+		_, err := m.db.Collection(collection).BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to save events to %s", collection)
+		}
+	}
+	return skipped, nil
+}
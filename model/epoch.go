@@ -0,0 +1,14 @@
+package model
+
+import "time"
+
+// filecoinGenesisUnix is the Unix time of the Filecoin mainnet genesis block. Each epoch lasts 30 seconds.
+const filecoinGenesisUnix = 1598306400
+
+func EpochToTime(epoch int32) time.Time {
+	return time.Unix(int64(epoch)*30+filecoinGenesisUnix, 0)
+}
+
+func TimeToEpoch(t time.Time) int32 {
+	return int32(t.Unix()-filecoinGenesisUnix) / 30
+}
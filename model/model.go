@@ -11,6 +11,19 @@ type Reporter struct {
 	InstanceID string `bson:"instanceId"`
 	IP         string `bson:"ip"`
 	Identity   string `bson:"identity"`
+	// IPTruncated is set once IP has been truncated to its network prefix by the IP retention policy.
+	IPTruncated bool `bson:"ipTruncated,omitempty"`
+	// Geo is the location of IP when it was reported, if GeoIP enrichment is enabled.
+	Geo *Geo `bson:"geo,omitempty"`
+}
+
+// Geo is the location of a reporter resolved from a GeoIP database.
+type Geo struct {
+	Country string `json:"country" bson:"country,omitempty"`
+	// Region is the ISO code of the largest subdivision of the country, such as a state or province.
+	Region string `json:"region" bson:"region,omitempty"`
+	ASN    uint   `json:"asn" bson:"asn,omitempty"`
+	ASOrg  string `json:"asOrg" bson:"asOrg,omitempty"`
 }
 
 type Car struct {
@@ -27,6 +40,8 @@ type Car struct {
 	FileSize    int64         `bson:"fileSize"`
 	NumOfFiles  int64         `bson:"numOfFiles"`
 	TimeSpent   time.Duration `bson:"timeSpent,omitempty"`
+	// Fingerprint identifies the v1 event the car was migrated from.
+	Fingerprint string `bson:"fingerprint,omitempty"`
 }
 
 type Deal struct {
@@ -48,6 +63,10 @@ type Deal struct {
 	Verified         bool      `bson:"verified"`
 	KeepUnsealed     *bool     `bson:"keepUnsealed,omitempty"`
 	Price            float64   `bson:"price"` // Fil per epoch per GiB
+	// PublishedAt is when the deal was first seen on chain, or its activation time if that is earlier.
+	PublishedAt *time.Time `bson:"publishedAt,omitempty"`
+	// Fingerprint identifies the v1 event the deal was migrated from.
+	Fingerprint string `bson:"fingerprint,omitempty"`
 }
 
 type ClientMapping struct {
@@ -55,3 +74,146 @@ type ClientMapping struct {
 	ActorID    string             `bson:"actorId"`
 	AccountKey string             `bson:"accountKey"`
 }
+
+type Allowance struct {
+	ID                     int64  `json:"id" bson:"id"`
+	Allowance              string `json:"allowance" bson:"allowance"`
+	AuditTrail             string `json:"auditTrail" bson:"auditTrail"`
+	VerifierAddressID      string `json:"verifierAddressId" bson:"verifierAddressId"`
+	MsgCID                 string `json:"msgCID" bson:"msgCid"`
+	Height                 int64  `json:"height" bson:"height"`
+	IsLdnAllowance         bool   `json:"isLdnAllowance" bson:"isLdnAllowance"`
+	CreateMessageTimestamp int64  `json:"createMessageTimestamp" bson:"createMessageTimestamp"`
+	IssueCreateTimestamp   int64  `json:"issueCreateTimestamp" bson:"issueCreateTimestamp"`
+}
+
+type VerifiedClient struct {
+	ID               int32       `json:"id" bson:"id"`
+	AddressID        string      `json:"addressId" bson:"addressId"`
+	Address          string      `json:"address" bson:"address"`
+	Name             string      `json:"name" bson:"name"`
+	OrgName          string      `json:"orgName" bson:"orgName"`
+	Region           string      `json:"region" bson:"region"`
+	Website          string      `json:"website" bson:"website"`
+	Industry         string      `json:"industry" bson:"industry"`
+	InitialAllowance string      `json:"initialAllowance" bson:"initialAllowance"`
+	AuditTrail       string      `json:"auditTrail" bson:"auditTrail"`
+	Allowances       []Allowance `json:"allowances" bson:"allowances"`
+	// Removed is set when the client is no longer returned by the source.
+	Removed   bool      `json:"removed" bson:"removed"`
+	Version   int       `json:"version" bson:"version"`
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"`
+}
+
+// VerifiedClientVersion is a snapshot of a verified client, recorded every time it changes.
+type VerifiedClientVersion struct {
+	ClientID  int32          `json:"clientId" bson:"clientId"`
+	Version   int            `json:"version" bson:"version"`
+	Change    string         `json:"change" bson:"change"`
+	ChangedAt time.Time      `json:"changedAt" bson:"changedAt"`
+	Client    VerifiedClient `json:"client" bson:"client"`
+}
+
+// DatasetKey identifies a dataset by the reporter that prepared it, which is the reporter identity,
+// or the instance ID for reporters without one, together with the dataset ID and name.
+type DatasetKey struct {
+	Reporter    string `json:"reporter" bson:"reporter"`
+	DatasetID   uint32 `json:"datasetId" bson:"datasetId"`
+	DatasetName string `json:"datasetName" bson:"datasetName"`
+}
+
+type Dataset struct {
+	Key          DatasetKey `json:"key" bson:"_id"`
+	IsV1         bool       `json:"isV1" bson:"isV1"`
+	FirstSeenAt  time.Time  `json:"firstSeenAt" bson:"firstSeenAt"`
+	LastSeenAt   time.Time  `json:"lastSeenAt" bson:"lastSeenAt"`
+	Cars         int64      `json:"cars" bson:"cars"`
+	Bytes        int64      `json:"bytes" bson:"bytes"`
+	Pieces       int64      `json:"pieces" bson:"pieces"`
+	ActivePieces int64      `json:"activePieces" bson:"activePieces"`
+	Replicas     int64      `json:"replicas" bson:"replicas"`
+	RefreshedAt  time.Time  `json:"refreshedAt" bson:"refreshedAt"`
+}
+
+// DatasetProgress is a snapshot of the totals of a dataset, recorded every time the datasets are refreshed.
+type DatasetProgress struct {
+	Key          DatasetKey `json:"key" bson:"key"`
+	At           time.Time  `json:"at" bson:"at"`
+	Cars         int64      `json:"cars" bson:"cars"`
+	Bytes        int64      `json:"bytes" bson:"bytes"`
+	Pieces       int64      `json:"pieces" bson:"pieces"`
+	ActivePieces int64      `json:"activePieces" bson:"activePieces"`
+	Replicas     int64      `json:"replicas" bson:"replicas"`
+}
+
+// Instance is a Singularity deployment that has reported to the metrics service.
+type Instance struct {
+	InstanceID  string    `json:"instanceId" bson:"_id"`
+	IsV1        bool      `json:"isV1" bson:"isV1"`
+	Identity    string    `json:"identity" bson:"identity"`
+	IPs         []string  `json:"ips" bson:"ips"`
+	FirstSeenAt time.Time `json:"firstSeenAt" bson:"firstSeenAt"`
+	LastSeenAt  time.Time `json:"lastSeenAt" bson:"lastSeenAt"`
+	Cars        int64     `json:"cars" bson:"cars"`
+	Deals       int64     `json:"deals" bson:"deals"`
+}
+
+type ScorecardKey struct {
+	Provider   string `json:"provider" bson:"provider"`
+	WindowDays int    `json:"windowDays" bson:"windowDays"`
+}
+
+// ProviderScorecard summarizes the outcome of the deals proposed to a provider within a rolling window.
+// Rates are relative to the proposals, except the slashing rate which is relative to the activated deals.
+type ProviderScorecard struct {
+	Key                 ScorecardKey `json:"key" bson:"_id"`
+	Proposals           int64        `json:"proposals" bson:"proposals"`
+	Accepted            int64        `json:"accepted" bson:"accepted"`
+	Activated           int64        `json:"activated" bson:"activated"`
+	ProposalExpired     int64        `json:"proposalExpired" bson:"proposalExpired"`
+	Slashed             int64        `json:"slashed" bson:"slashed"`
+	AcceptanceRate      float64      `json:"acceptanceRate" bson:"acceptanceRate"`
+	ActivationRate      float64      `json:"activationRate" bson:"activationRate"`
+	ProposalExpiredRate float64      `json:"proposalExpiredRate" bson:"proposalExpiredRate"`
+	SlashingRate        float64      `json:"slashingRate" bson:"slashingRate"`
+	AveragePrice        *float64     `json:"averagePrice" bson:"averagePrice"`
+	VerifiedRatio       float64      `json:"verifiedRatio" bson:"verifiedRatio"`
+	ComputedAt          time.Time    `json:"computedAt" bson:"computedAt"`
+}
+
+// APIKey authenticates the reports of a Singularity deployment. Only the hash of the key is stored.
+type APIKey struct {
+	ID     primitive.ObjectID `json:"id" bson:"_id"`
+	Hash   string             `json:"-" bson:"hash"`
+	Prefix string             `json:"prefix" bson:"prefix"`
+	// Identity replaces the identity claimed by the reports sent with the key.
+	Identity string `json:"identity" bson:"identity"`
+	// InstanceID restricts the key to a single instance if set.
+	InstanceID string     `json:"instanceId,omitempty" bson:"instanceId,omitempty"`
+	Note       string     `json:"note,omitempty" bson:"note,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt" bson:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+}
+
+// Quarantine describes why a reported record was held back from the main collections for review.
+type Quarantine struct {
+	// BatchID groups the records received in the same request, which are quarantined together.
+	BatchID primitive.ObjectID `json:"batchId" bson:"batchId"`
+	// Kind is "car" or "deal".
+	Kind string `json:"kind" bson:"kind"`
+	// Reasons lists the failed checks of the record, and is empty for the records quarantined with them.
+	Reasons       []string  `json:"reasons,omitempty" bson:"reasons,omitempty"`
+	QuarantinedAt time.Time `json:"quarantinedAt" bson:"quarantinedAt"`
+}
+
+// QuarantineBatch summarizes the records of a quarantined request.
+type QuarantineBatch struct {
+	BatchID       primitive.ObjectID `json:"batchId" bson:"_id"`
+	QuarantinedAt time.Time          `json:"quarantinedAt" bson:"quarantinedAt"`
+	InstanceIDs   []string           `json:"instanceIds" bson:"instanceIds"`
+	IPs           []string           `json:"ips" bson:"ips"`
+	Cars          int64              `json:"cars" bson:"cars"`
+	Deals         int64              `json:"deals" bson:"deals"`
+	Reasons       []string           `json:"reasons" bson:"reasons"`
+}
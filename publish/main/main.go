@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/data-preservation-programs/singularity-metrics/geoip"
+	"github.com/data-preservation-programs/singularity-metrics/publish"
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func publishAction(c *cli.Context) error {
+	opts := publish.Options{
+		Dir:     c.String("dir"),
+		Version: c.String("version"),
+		Format:  c.String("format"),
+		Zstd:    c.Bool("zstd"),
+		Salt:    c.String("salt"),
+	}
+	if path := c.String("geoip-db"); path != "" {
+		countries, err := geoip.Open(path)
+		if err != nil {
+			return err
+		}
+		defer countries.Close()
+		opts.Countries = countries
+	}
+
+	mg, err := mongo.Connect(c.Context, options.Client().ApplyURI(c.String("mongodb-uri")))
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to mongo")
+	}
+	defer func() {
+		_ = mg.Disconnect(context.Background())
+	}()
+	manifest, err := publish.Publish(c.Context, mg.Database("singularity"), opts)
+	if err != nil {
+		return err
+	}
+	log.Printf("published snapshot %s\n", manifest.Version)
+	return nil
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app := &cli.App{
+		Name:  "publish",
+		Usage: "Publish an anonymized snapshot of cars and deals",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "mongodb-uri", Usage: "MongoDB connection string", EnvVars: []string{"MONGODB_URI"}},
+			&cli.StringFlag{Name: "dir", Usage: "Directory that holds the snapshot versions", Value: "snapshots"},
+			&cli.StringFlag{Name: "version", Usage: "Snapshot version, the current time by default"},
+			&cli.StringFlag{Name: "format", Usage: "File format, csv, jsonl or parquet", Value: "parquet"},
+			&cli.BoolFlag{Name: "zstd", Usage: "Compress the files with zstd"},
+			&cli.StringFlag{
+				Name:     "salt",
+				Usage:    "Secret salt of the instance and identity pseudonyms, keep it to keep pseudonyms stable across versions",
+				EnvVars:  []string{"PUBLISH_SALT"},
+				Required: true,
+			},
+			&cli.StringFlag{
+				Name:    "geoip-db",
+				Usage:   "MaxMind country or city database to generalize IPs to countries, IPs are dropped if not set",
+				EnvVars: []string{"GEOIP_DB"},
+			},
+		},
+		Action: publishAction,
+	}
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		panic(err)
+	}
+}
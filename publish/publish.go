@@ -0,0 +1,321 @@
+package publish
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/export"
+	"github.com/data-preservation-programs/singularity-metrics/geoip"
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// minSaltLength keeps pseudonyms from being reversed by hashing every known instance ID.
+const minSaltLength = 16
+
+type Options struct {
+	// Dir is the directory that holds a subdirectory per snapshot version.
+	Dir string
+	// Version names the snapshot, the creation time by default.
+	Version string
+	Format  string
+	Zstd    bool
+	// Salt keys the pseudonyms. Keeping the salt between snapshots keeps the pseudonyms stable across them.
+	Salt string
+	// Countries generalizes IPs to their country if set. IPs are dropped otherwise.
+	Countries *geoip.Resolver
+}
+
+type File struct {
+	Name       string `json:"name"`
+	Collection string `json:"collection"`
+	Rows       int64  `json:"rows"`
+	Bytes      int64  `json:"bytes"`
+	SHA256     string `json:"sha256"`
+}
+
+type Manifest struct {
+	Version     string    `json:"version"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Format      string    `json:"format"`
+	Compression string    `json:"compression,omitempty"`
+	// Pseudonyms describes how instance IDs and identities were replaced.
+	Pseudonyms string `json:"pseudonyms"`
+	// IPs is "dropped" or "country".
+	IPs   string `json:"ips"`
+	Files []File `json:"files"`
+}
+
+type PublicCarRow struct {
+	Instance    string  `json:"instance" parquet:"name=instance, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Identity    string  `json:"identity" parquet:"name=identity, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Country     string  `json:"country" parquet:"name=country, type=BYTE_ARRAY, convertedtype=UTF8"`
+	IsV1        bool    `json:"isV1" parquet:"name=isV1, type=BOOLEAN"`
+	DatasetID   *int64  `json:"datasetId" parquet:"name=datasetId, type=INT64, repetitiontype=OPTIONAL"`
+	DatasetName string  `json:"datasetName" parquet:"name=datasetName, type=BYTE_ARRAY, convertedtype=UTF8"`
+	CreatedAt   int64   `json:"createdAt" export:"time" parquet:"name=createdAt, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	PieceCID    string  `json:"pieceCid" parquet:"name=pieceCid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PieceSize   int64   `json:"pieceSize" parquet:"name=pieceSize, type=INT64"`
+	FileSize    int64   `json:"fileSize" parquet:"name=fileSize, type=INT64"`
+	NumOfFiles  int64   `json:"numOfFiles" parquet:"name=numOfFiles, type=INT64"`
+	TimeSpentMs float64 `json:"timeSpentMs" parquet:"name=timeSpentMs, type=DOUBLE"`
+}
+
+type PublicDealRow struct {
+	Instance         string  `json:"instance" parquet:"name=instance, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Identity         string  `json:"identity" parquet:"name=identity, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Country          string  `json:"country" parquet:"name=country, type=BYTE_ARRAY, convertedtype=UTF8"`
+	IsV1             bool    `json:"isV1" parquet:"name=isV1, type=BOOLEAN"`
+	CreatedAt        int64   `json:"createdAt" export:"time" parquet:"name=createdAt, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	DealID           *int64  `json:"dealId" parquet:"name=dealId, type=INT64, repetitiontype=OPTIONAL"`
+	Client           string  `json:"client" parquet:"name=client, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Provider         string  `json:"provider" parquet:"name=provider, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Label            string  `json:"label" parquet:"name=label, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PieceCID         string  `json:"pieceCid" parquet:"name=pieceCid, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PieceSize        int64   `json:"pieceSize" parquet:"name=pieceSize, type=INT64"`
+	State            string  `json:"state" parquet:"name=state, type=BYTE_ARRAY, convertedtype=UTF8"`
+	StartEpoch       *int32  `json:"startEpoch" parquet:"name=startEpoch, type=INT32, repetitiontype=OPTIONAL"`
+	SectorStartEpoch *int32  `json:"sectorStartEpoch" parquet:"name=sectorStartEpoch, type=INT32, repetitiontype=OPTIONAL"`
+	EndEpoch         *int32  `json:"endEpoch" parquet:"name=endEpoch, type=INT32, repetitiontype=OPTIONAL"`
+	Duration         int32   `json:"duration" parquet:"name=duration, type=INT32"`
+	Verified         bool    `json:"verified" parquet:"name=verified, type=BOOLEAN"`
+	Price            float64 `json:"price" parquet:"name=price, type=DOUBLE"`
+}
+
+type anonymizer struct {
+	salt      []byte
+	countries *geoip.Resolver
+}
+
+// pseudonym replaces an identifier with a keyed hash. Deals found on chain keep their "external" instance,
+// since it names no deployment.
+func (a anonymizer) pseudonym(kind string, id string) string {
+	if id == "" || (kind == "instance" && id == "external") {
+		return id
+	}
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(kind + ":" + id))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// country prefers the location resolved at ingestion, which is more precise than a lookup of a truncated IP.
+func (a anonymizer) country(reporter model.Reporter) string {
+	if a.countries == nil {
+		return ""
+	}
+	if reporter.Geo != nil && reporter.Geo.Country != "" {
+		return reporter.Geo.Country
+	}
+	if reporter.IP == "" {
+		return ""
+	}
+	return a.countries.Country(reporter.IP)
+}
+
+func (a anonymizer) car(car model.Car) PublicCarRow {
+	row := PublicCarRow{
+		Instance:    a.pseudonym("instance", car.InstanceID),
+		Identity:    a.pseudonym("identity", car.Identity),
+		Country:     a.country(car.Reporter),
+		IsV1:        car.IsV1,
+		DatasetName: car.DatasetName,
+		CreatedAt:   car.CreatedAt.UnixMilli(),
+		PieceCID:    car.PieceCID,
+		PieceSize:   car.PieceSize,
+		FileSize:    car.FileSize,
+		NumOfFiles:  car.NumOfFiles,
+		TimeSpentMs: float64(car.TimeSpent) / float64(time.Millisecond),
+	}
+	if car.DatasetID != nil {
+		datasetID := int64(*car.DatasetID)
+		row.DatasetID = &datasetID
+	}
+	return row
+}
+
+func (a anonymizer) deal(deal model.Deal) PublicDealRow {
+	row := PublicDealRow{
+		Instance:         a.pseudonym("instance", deal.InstanceID),
+		Identity:         a.pseudonym("identity", deal.Identity),
+		Country:          a.country(deal.Reporter),
+		IsV1:             deal.IsV1,
+		CreatedAt:        deal.CreatedAt.UnixMilli(),
+		Client:           deal.Client,
+		Provider:         deal.Provider,
+		Label:            deal.Label,
+		PieceCID:         deal.PieceCID,
+		PieceSize:        deal.PieceSize,
+		State:            deal.State,
+		StartEpoch:       deal.StartEpoch,
+		SectorStartEpoch: deal.SectorStartEpoch,
+		EndEpoch:         deal.EndEpoch,
+		Duration:         deal.Duration,
+		Verified:         deal.Verified,
+		Price:            deal.Price,
+	}
+	if deal.DealID != nil {
+		dealID := int64(*deal.DealID)
+		row.DealID = &dealID
+	}
+	return row
+}
+
+// countingWriter counts the bytes written to a snapshot file.
+type countingWriter struct {
+	w     io.Writer
+	bytes int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+// writeCollection writes every document of a collection as an anonymized row to a file in dir.
+func writeCollection(ctx context.Context, db *mongo.Database, dir string, collection string, opts Options,
+	prototype any, row func(cursor *mongo.Cursor) (any, error)) (File, error) {
+	file := File{Name: collection + export.Extension(opts.Format, opts.Zstd), Collection: collection}
+	f, err := os.Create(filepath.Join(dir, file.Name))
+	if err != nil {
+		return file, errors.Wrap(err, "failed to create snapshot file")
+	}
+	defer f.Close()
+	hash := sha256.New()
+	out := &countingWriter{w: io.MultiWriter(f, hash)}
+	rw, err := export.NewWriter(out, opts.Format, opts.Zstd, prototype)
+	if err != nil {
+		return file, err
+	}
+
+	cursor, err := db.Collection(collection).Find(ctx, bson.M{}, options.Find().SetBatchSize(1000))
+	if err != nil {
+		return file, errors.Wrapf(err, "failed to query %s", collection)
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		r, err := row(cursor)
+		if err != nil {
+			return file, errors.Wrapf(err, "failed to decode %s", collection)
+		}
+		err = rw.Write(r)
+		if err != nil {
+			return file, err
+		}
+		file.Rows++
+	}
+	if err := cursor.Err(); err != nil {
+		return file, errors.Wrapf(err, "failed to iterate %s", collection)
+	}
+	err = rw.Close()
+	if err != nil {
+		return file, err
+	}
+	err = f.Close()
+	if err != nil {
+		return file, errors.Wrap(err, "failed to write snapshot file")
+	}
+	file.Bytes = out.bytes
+	file.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	log.Printf("wrote %d %s to %s\n", file.Rows, collection, file.Name)
+	return file, nil
+}
+
+// Publish writes an anonymized snapshot of cars and deals to a new version directory, along with a manifest and
+// a SHA256SUMS file. The snapshot is written to a temporary directory first, so a version directory is always complete.
+func Publish(ctx context.Context, db *mongo.Database, opts Options) (*Manifest, error) {
+	if len(opts.Salt) < minSaltLength {
+		return nil, errors.Errorf("salt must be at least %d characters", minSaltLength)
+	}
+	now := time.Now().UTC()
+	if opts.Version == "" {
+		opts.Version = now.Format("20060102T150405Z")
+	}
+	if strings.ContainsAny(opts.Version, `/\`) || strings.HasPrefix(opts.Version, ".") {
+		return nil, errors.Errorf("invalid version %q", opts.Version)
+	}
+	final := filepath.Join(opts.Dir, opts.Version)
+	if _, err := os.Stat(final); err == nil {
+		return nil, errors.Errorf("snapshot %s already exists", opts.Version)
+	}
+	dir := final + ".partial"
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to clear partial snapshot")
+	}
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create snapshot directory")
+	}
+
+	a := anonymizer{salt: []byte(opts.Salt), countries: opts.Countries}
+	manifest := &Manifest{
+		Version:    opts.Version,
+		CreatedAt:  now,
+		Format:     opts.Format,
+		Pseudonyms: "hmac-sha256 of instance IDs and identities with an unpublished salt",
+		IPs:        "dropped",
+	}
+	if opts.Zstd {
+		manifest.Compression = "zstd"
+	}
+	if opts.Countries != nil {
+		manifest.IPs = "country"
+	}
+
+	carsFile, err := writeCollection(ctx, db, dir, "cars", opts, PublicCarRow{}, func(cursor *mongo.Cursor) (any, error) {
+		var car model.Car
+		err := cursor.Decode(&car)
+		return a.car(car), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	dealsFile, err := writeCollection(ctx, db, dir, "deals", opts, PublicDealRow{}, func(cursor *mongo.Cursor) (any, error) {
+		var deal model.Deal
+		err := cursor.Decode(&deal)
+		return a.deal(deal), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	manifest.Files = []File{carsFile, dealsFile}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode manifest")
+	}
+	err = os.WriteFile(filepath.Join(dir, "manifest.json"), manifestJSON, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write manifest")
+	}
+	manifestSum := sha256.Sum256(manifestJSON)
+	var sums strings.Builder
+	for _, f := range manifest.Files {
+		fmt.Fprintf(&sums, "%s  %s\n", f.SHA256, f.Name)
+	}
+	fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(manifestSum[:]), "manifest.json")
+	err = os.WriteFile(filepath.Join(dir, "SHA256SUMS"), []byte(sums.String()), 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write checksums")
+	}
+
+	err = os.Rename(dir, final)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to finalize snapshot")
+	}
+	return manifest, nil
+}
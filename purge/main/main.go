@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/data-preservation-programs/singularity-metrics/purge"
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func printCounts(title string, counts map[string]int64) error {
+	collections := make([]string, 0, len(counts))
+	for collection := range counts {
+		collections = append(collections, collection)
+	}
+	sort.Strings(collections)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "COLLECTION\t%s\n", title)
+	for _, collection := range collections {
+		fmt.Fprintf(tw, "%s\t%d\n", collection, counts[collection])
+	}
+	return errors.Wrap(tw.Flush(), "failed to write counts")
+}
+
+// purgeAction always counts the selected records first, and only changes them with --yes.
+func purgeAction(c *cli.Context) error {
+	req := purge.Request{
+		Selector: purge.Selector{
+			InstanceID: c.String("instance-id"),
+			Identity:   c.String("identity"),
+			IP:         c.String("ip"),
+		},
+		Mode:        purge.ModeDelete,
+		DryRun:      true,
+		Reason:      c.String("reason"),
+		RequestedBy: c.String("requested-by"),
+		AuditKey:    []byte(c.String("audit-key")),
+	}
+	if c.Bool("anonymize") {
+		req.Mode = purge.ModeAnonymize
+	}
+
+	mg, err := mongo.Connect(c.Context, options.Client().ApplyURI(c.String("mongodb-uri")))
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to mongo")
+	}
+	defer func() {
+		_ = mg.Disconnect(context.Background())
+	}()
+	db := mg.Database("singularity")
+
+	audit, err := purge.Purge(c.Context, db, req)
+	if err != nil {
+		return err
+	}
+	err = printCounts("MATCHED", audit.Matched)
+	if err != nil {
+		return err
+	}
+	if !c.Bool("yes") {
+		fmt.Printf("dry run: rerun with --yes to %s these records\n", req.Mode)
+		return nil
+	}
+
+	req.DryRun = false
+	audit, err = purge.Purge(c.Context, db, req)
+	if audit != nil {
+		printErr := printCounts("PURGED", audit.Purged)
+		if err == nil {
+			err = printErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("recorded audit %s\n", audit.ID.Hex())
+	return nil
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app := &cli.App{
+		Name:      "purge",
+		Usage:     "Delete or anonymize every record of a deployment, selected by instance ID, identity or IP",
+		UsageText: "purge (--instance-id ID | --identity IDENTITY | --ip IP) [--anonymize] --reason REASON [--yes]",
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "mongodb-uri", Usage: "MongoDB connection string", EnvVars: []string{"MONGODB_URI"}},
+			&cli.StringFlag{Name: "instance-id", Usage: "Select the records reported by the instance"},
+			&cli.StringFlag{Name: "identity", Usage: "Select the records reported with the identity"},
+			&cli.StringFlag{Name: "ip", Usage: "Select the records reported from the IP"},
+			&cli.BoolFlag{Name: "anonymize", Usage: "Keep the records for aggregate statistics without what identifies the deployment"},
+			&cli.StringFlag{Name: "reason", Usage: "Why the records are purged, such as a ticket reference", Required: true},
+			&cli.StringFlag{Name: "requested-by", Usage: "Who runs the purge", EnvVars: []string{"USER"}},
+			&cli.StringFlag{Name: "audit-key", Usage: "Secret the audit hashes the purged value with, the value is not recorded without it", EnvVars: []string{"PURGE_AUDIT_KEY"}},
+			&cli.BoolFlag{Name: "yes", Usage: "Purge the records after counting them, instead of a dry run"},
+		},
+		Action: purgeAction,
+	}
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,377 @@
+package purge
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/dataset"
+	"github.com/data-preservation-programs/singularity-metrics/instance"
+	"github.com/data-preservation-programs/singularity-metrics/retention"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	AuditCollection = "purgeAudits"
+	ModeDelete      = "delete"
+	ModeAnonymize   = "anonymize"
+)
+
+// Selector selects the records of a deployment by exactly one of its instance ID, identity or IP.
+type Selector struct {
+	InstanceID string `json:"instanceId,omitempty"`
+	Identity   string `json:"identity,omitempty"`
+	IP         string `json:"ip,omitempty"`
+}
+
+func (s Selector) field() (string, string, error) {
+	var field, value string
+	for name, v := range map[string]string{"instanceId": s.InstanceID, "identity": s.Identity, "ip": s.IP} {
+		if v == "" {
+			continue
+		}
+		if field != "" {
+			return "", "", errors.New("select records by only one of instance ID, identity or IP")
+		}
+		field, value = name, v
+	}
+	if field == "" {
+		return "", "", errors.New("select records by instance ID, identity or IP")
+	}
+	// Deals found on chain are not telemetry of any deployment.
+	if field == "instanceId" && value == "external" {
+		return "", "", errors.New("the external instance cannot be purged")
+	}
+	return field, value, nil
+}
+
+type Request struct {
+	Selector
+	// Mode is "delete" or "anonymize". Anonymizing keeps the records for aggregate statistics, with the instance ID
+	// replaced by a random one and the identity, IP and location cleared.
+	Mode        string `json:"mode"`
+	DryRun      bool   `json:"dryRun"`
+	Reason      string `json:"reason"`
+	RequestedBy string `json:"requestedBy"`
+	// AuditKey is the secret the audit hashes the purged value with. The value is not recorded without a key.
+	AuditKey []byte `json:"-"`
+}
+
+func (r Request) Validate() error {
+	if _, _, err := r.Selector.field(); err != nil {
+		return err
+	}
+	if r.Mode != ModeDelete && r.Mode != ModeAnonymize {
+		return errors.Errorf("unknown purge mode %q", r.Mode)
+	}
+	return nil
+}
+
+// Audit records a purge. The purged value is kept as an HMAC keyed with a secret, so that the audit does not retain
+// it and it cannot be recovered by hashing candidate values, but a later request for the same value can be matched.
+// The network prefix of a purged IP under the retention policy, whose truncated records are purged as well, is kept
+// the same way.
+type Audit struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Field       string             `json:"field" bson:"field"`
+	ValueHMAC   string             `json:"valueHmac,omitempty" bson:"valueHmac,omitempty"`
+	PrefixHMAC  string             `json:"prefixHmac,omitempty" bson:"prefixHmac,omitempty"`
+	Mode        string             `json:"mode" bson:"mode"`
+	DryRun      bool               `json:"dryRun" bson:"-"`
+	Reason      string             `json:"reason" bson:"reason"`
+	RequestedBy string             `json:"requestedBy" bson:"requestedBy"`
+	StartedAt   time.Time          `json:"startedAt" bson:"startedAt"`
+	FinishedAt  time.Time          `json:"finishedAt" bson:"finishedAt"`
+	// Matched is the number of documents selected in each collection, counted before anything is changed.
+	Matched map[string]int64 `json:"matched" bson:"matched"`
+	// Purged is the number of documents deleted or anonymized in each collection.
+	Purged map[string]int64 `json:"purged,omitempty" bson:"purged"`
+	Error  string           `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// target is a collection holding records of the selected deployment, and what is done to them.
+type target struct {
+	collection string
+	filter     bson.M
+	// anonymize returns the update that anonymizes the documents, or nil if they are deleted in both modes.
+	anonymize func(instanceID string) bson.M
+	// byInstance anonymizes the documents of each instance separately, so that they keep a distinct instance ID.
+	byInstance bool
+	// keep anonymizes the documents in both modes, for records that only partly belong to the selected deployment.
+	keep bool
+}
+
+// scope is what a selector resolves to: the instances that reported with it and the dataset reporters derived
+// from them.
+type scope struct {
+	field     string
+	value     string
+	instances []string
+	// reporters are the dataset reporters whose cars are all selected. A reporter that also holds cars of other
+	// deployments, such as an identity shared with them, keeps its datasets, which the next refresh recomputes.
+	reporters []string
+	// pseudonyms are the random instance IDs that replace the selected ones when anonymizing.
+	pseudonyms map[string]string
+	// prefix is the network prefix of the selected IP under the retention policy, if it differs from the IP. The
+	// records whose IP was truncated to it are selected as well, including those of other deployments on the same
+	// network.
+	prefix string
+}
+
+func distinct(ctx context.Context, db *mongo.Database, collection string, field string, filter bson.M, into map[string]bool) error {
+	values, err := db.Collection(collection).Distinct(ctx, field, filter)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list %s of %s", field, collection)
+	}
+	for _, v := range values {
+		if s, ok := v.(string); ok && s != "" {
+			into[s] = true
+		}
+	}
+	return nil
+}
+
+func keys(m map[string]bool) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	return result
+}
+
+func resolve(ctx context.Context, db *mongo.Database, field string, value string) (*scope, error) {
+	s := &scope{field: field, value: value}
+	if field == "ip" {
+		policy, err := retention.PolicyFromEnv()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the retention policy")
+		}
+		if prefix := policy.Truncate(value); prefix != "" && prefix != value {
+			s.prefix = prefix
+		}
+		return s, nil
+	}
+	instances := map[string]bool{}
+	identities := map[string]bool{}
+	if field == "instanceId" {
+		instances[value] = true
+	} else {
+		identities[value] = true
+	}
+	filter := bson.M{field: value}
+	for _, collection := range []string{"cars", "deals"} {
+		if err := distinct(ctx, db, collection, "instanceId", filter, instances); err != nil {
+			return nil, err
+		}
+		if err := distinct(ctx, db, collection, "identity", filter, identities); err != nil {
+			return nil, err
+		}
+	}
+	instanceFilter := bson.M{"_id": value}
+	if field == "identity" {
+		instanceFilter = bson.M{"identity": value}
+	}
+	if err := distinct(ctx, db, instance.Collection, "_id", instanceFilter, instances); err != nil {
+		return nil, err
+	}
+	delete(instances, "external")
+	s.instances = keys(instances)
+	s.reporters = []string{}
+	for _, reporter := range append(keys(identities), s.instances...) {
+		owned, err := ownsReporter(ctx, db, filter, reporter)
+		if err != nil {
+			return nil, err
+		}
+		if owned {
+			s.reporters = append(s.reporters, reporter)
+		}
+	}
+	s.pseudonyms = make(map[string]string, len(s.instances))
+	for _, id := range s.instances {
+		s.pseudonyms[id] = randomInstanceID()
+	}
+	return s, nil
+}
+
+// ownsReporter tells whether every car of a dataset reporter is selected by the filter. Datasets are keyed by the
+// identity of the cars, or their instance ID for cars without one.
+func ownsReporter(ctx context.Context, db *mongo.Database, filter bson.M, reporter string) (bool, error) {
+	count, err := db.Collection("cars").CountDocuments(ctx, bson.M{"$and": bson.A{
+		bson.M{"$or": bson.A{
+			bson.M{"identity": reporter},
+			bson.M{"identity": bson.M{"$in": bson.A{"", nil}}, "instanceId": reporter},
+		}},
+		bson.M{"$nor": bson.A{filter}},
+	}}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, errors.Wrap(err, "failed to count cars of other deployments")
+	}
+	return count == 0, nil
+}
+
+func randomInstanceID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "anonymized-" + hex.EncodeToString(b)
+}
+
+func (s *scope) rateLimitKeys() []string {
+	keys := make([]string, 0, len(s.instances))
+	for _, id := range s.instances {
+		keys = append(keys, "instance:"+id)
+	}
+	return keys
+}
+
+func (s *scope) targets() []target {
+	reporterFilter := bson.M{s.field: s.value}
+	clearReporter := func(instanceID string) bson.M {
+		if s.field == "ip" {
+			return bson.M{"$set": bson.M{"ip": ""}, "$unset": bson.M{"geo": "", "ipTruncated": ""}}
+		}
+		return bson.M{
+			"$set":   bson.M{"instanceId": instanceID, "identity": "", "ip": ""},
+			"$unset": bson.M{"geo": "", "ipTruncated": ""},
+		}
+	}
+	if s.field == "ip" {
+		ips := bson.A{s.value}
+		if s.prefix != "" {
+			reporterFilter = bson.M{"$or": bson.A{reporterFilter, bson.M{"ip": s.prefix, "ipTruncated": true}}}
+			ips = append(ips, s.prefix)
+		}
+		return []target{
+			{collection: "cars", filter: reporterFilter, anonymize: clearReporter},
+			{collection: "deals", filter: reporterFilter, anonymize: clearReporter},
+			{collection: "quarantine", filter: reporterFilter, anonymize: clearReporter},
+			{collection: "rateLimits", filter: bson.M{"_id": "ip:" + s.value}},
+			{collection: "v1Events", filter: reporterFilter, anonymize: func(string) bson.M {
+				return bson.M{"$set": bson.M{"ip": ""}, "$unset": bson.M{"ipTruncated": ""}}
+			}},
+			// The instances that reported from the IP are kept, without the IP. The registry does not mark
+			// truncated IPs, so the prefix is removed wherever it is found.
+			{collection: instance.Collection, filter: bson.M{"ips": bson.M{"$in": ips}}, keep: true,
+				anonymize: func(string) bson.M {
+					return bson.M{"$pull": bson.M{"ips": bson.M{"$in": ips}}}
+				}},
+		}
+	}
+	// The registry and the datasets are derived from cars and deals, and are rebuilt under the random instance IDs
+	// by the next refresh when anonymizing.
+	return []target{
+		{collection: "cars", filter: reporterFilter, anonymize: clearReporter, byInstance: true},
+		{collection: "deals", filter: reporterFilter, anonymize: clearReporter, byInstance: true},
+		{collection: "quarantine", filter: reporterFilter, anonymize: clearReporter, byInstance: true},
+		{collection: "v1Events", filter: bson.M{"instanceId": bson.M{"$in": s.instances}}, byInstance: true,
+			anonymize: func(instanceID string) bson.M {
+				return bson.M{"$set": bson.M{"instanceId": instanceID, "ip": ""}}
+			}},
+		{collection: instance.Collection, filter: bson.M{"_id": bson.M{"$in": s.instances}}},
+		{collection: "rateLimits", filter: bson.M{"_id": bson.M{"$in": s.rateLimitKeys()}}},
+		{collection: dataset.Collection, filter: bson.M{"_id.reporter": bson.M{"$in": s.reporters}}},
+		{collection: dataset.ProgressCollection, filter: bson.M{"key.reporter": bson.M{"$in": s.reporters}}},
+	}
+}
+
+func (s *scope) apply(ctx context.Context, db *mongo.Database, t target, mode string) (int64, error) {
+	coll := db.Collection(t.collection)
+	if t.anonymize == nil || (mode == ModeDelete && !t.keep) {
+		result, err := coll.DeleteMany(ctx, t.filter)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to delete from %s", t.collection)
+		}
+		return result.DeletedCount, nil
+	}
+	if !t.byInstance {
+		result, err := coll.UpdateMany(ctx, t.filter, t.anonymize(""))
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to anonymize %s", t.collection)
+		}
+		return result.ModifiedCount, nil
+	}
+	var total int64
+	for _, instanceID := range s.instances {
+		filter := bson.M{"$and": bson.A{t.filter, bson.M{"instanceId": instanceID}}}
+		result, err := coll.UpdateMany(ctx, filter, t.anonymize(s.pseudonyms[instanceID]))
+		if err != nil {
+			return total, errors.Wrapf(err, "failed to anonymize %s", t.collection)
+		}
+		total += result.ModifiedCount
+	}
+	return total, nil
+}
+
+func auditHMAC(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Purge counts the records selected by the request in every collection that holds telemetry, including the raw
+// v1 events, then deletes or anonymizes them unless it is a dry run. Every purge that is not a dry run is audited,
+// even if it fails part way. Records that the v1 migration reads from the legacy database are imported again by
+// a later migration with a new checkpoint, so they must be removed at the source as well.
+func Purge(ctx context.Context, db *mongo.Database, req Request) (*Audit, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	field, value, _ := req.Selector.field()
+	audit := &Audit{
+		Field:       field,
+		Mode:        req.Mode,
+		DryRun:      req.DryRun,
+		Reason:      req.Reason,
+		RequestedBy: req.RequestedBy,
+		StartedAt:   time.Now().UTC(),
+		Matched:     make(map[string]int64),
+	}
+	s, err := resolve(ctx, db, field, value)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.AuditKey) > 0 {
+		audit.ValueHMAC = auditHMAC(req.AuditKey, value)
+		if s.prefix != "" {
+			audit.PrefixHMAC = auditHMAC(req.AuditKey, s.prefix)
+		}
+	}
+	targets := s.targets()
+	for _, t := range targets {
+		audit.Matched[t.collection], err = db.Collection(t.collection).CountDocuments(ctx, t.filter)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to count %s", t.collection)
+		}
+	}
+	if req.DryRun {
+		audit.FinishedAt = time.Now().UTC()
+		return audit, nil
+	}
+
+	audit.Purged = make(map[string]int64)
+	for _, t := range targets {
+		var n int64
+		n, err = s.apply(ctx, db, t, req.Mode)
+		audit.Purged[t.collection] = n
+		if err != nil {
+			break
+		}
+		log.Printf("purged %d documents from %s\n", n, t.collection)
+	}
+	audit.FinishedAt = time.Now().UTC()
+	if err != nil {
+		audit.Error = err.Error()
+	}
+	_, auditErr := db.Collection(AuditCollection).InsertOne(ctx, audit)
+	if err != nil {
+		return audit, err
+	}
+	return audit, errors.Wrap(auditErr, "failed to record purge audit")
+}
@@ -0,0 +1,129 @@
+package ratelimit
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const Collection = "rateLimits"
+
+var ErrLimited = errors.New("rate limit exceeded")
+
+// Limit is a token bucket counted in records. Batches larger than the burst are accepted from a full bucket,
+// which then stays in debt until it is refilled.
+type Limit struct {
+	Burst   float64 `json:"burst"`
+	PerHour float64 `json:"perHour"`
+}
+
+func (l Limit) Enabled() bool {
+	return l.PerHour > 0
+}
+
+// Limits are applied to every request, keyed by its source IP and by each instance it reports for.
+// The buckets are kept in the database, since they are shared by every running handler.
+type Limits struct {
+	IP       Limit `json:"ip"`
+	Instance Limit `json:"instance"`
+}
+
+func limitFromEnv(name string) (Limit, error) {
+	var limit Limit
+	var err error
+	if value := os.Getenv("RATE_LIMIT_" + name + "_PER_HOUR"); value != "" {
+		limit.PerHour, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return limit, errors.Wrapf(err, "invalid RATE_LIMIT_%s_PER_HOUR", name)
+		}
+	}
+	limit.Burst = limit.PerHour
+	if value := os.Getenv("RATE_LIMIT_" + name + "_BURST"); value != "" {
+		limit.Burst, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return limit, errors.Wrapf(err, "invalid RATE_LIMIT_%s_BURST", name)
+		}
+	}
+	return limit, nil
+}
+
+// LimitsFromEnv reads the limits from RATE_LIMIT_IP_PER_HOUR, RATE_LIMIT_IP_BURST, RATE_LIMIT_INSTANCE_PER_HOUR
+// and RATE_LIMIT_INSTANCE_BURST. A limit without a rate is disabled, and its burst defaults to an hour of records.
+func LimitsFromEnv() (Limits, error) {
+	ip, err := limitFromEnv("IP")
+	if err != nil {
+		return Limits{}, err
+	}
+	instance, err := limitFromEnv("INSTANCE")
+	if err != nil {
+		return Limits{}, err
+	}
+	return Limits{IP: ip, Instance: instance}, nil
+}
+
+// take refills the bucket for the time since it was last used, then takes cost tokens from it if it holds
+// enough, all in a single atomic update.
+func take(ctx context.Context, db *mongo.Database, key string, limit Limit, cost float64, now time.Time) (bool, error) {
+	elapsed := bson.M{"$divide": bson.A{bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updatedAt", now}}}}, 1000}}
+	refilled := bson.M{"$min": bson.A{limit.Burst, bson.M{"$add": bson.A{
+		bson.M{"$ifNull": bson.A{"$tokens", limit.Burst}},
+		bson.M{"$multiply": bson.A{limit.PerHour / 3600, elapsed}},
+	}}}}
+	var bucket struct {
+		Allowed bool `bson:"allowed"`
+	}
+	err := db.Collection(Collection).FindOneAndUpdate(ctx, bson.M{"_id": key}, bson.A{
+		bson.M{"$set": bson.M{"tokens": refilled, "updatedAt": now}},
+		bson.M{"$set": bson.M{"allowed": bson.M{"$gte": bson.A{"$tokens", minFloat(cost, limit.Burst)}}}},
+		bson.M{"$set": bson.M{"tokens": bson.M{"$cond": bson.A{"$allowed", bson.M{"$subtract": bson.A{"$tokens", cost}}, "$tokens"}}}},
+	}, options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&bucket)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to update rate limit")
+	}
+	return bucket.Allowed, nil
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Allow takes tokens for the records of a request from the bucket of its source IP, then from the bucket of each
+// instance. It returns ErrLimited for the first bucket that is exhausted; tokens already taken are not returned.
+func Allow(ctx context.Context, db *mongo.Database, limits Limits, ip string, recordsByInstance map[string]int) error {
+	now := time.Now().UTC()
+	if limits.IP.Enabled() && ip != "" {
+		total := 0
+		for _, n := range recordsByInstance {
+			total += n
+		}
+		allowed, err := take(ctx, db, "ip:"+ip, limits.IP, float64(total), now)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return errors.Wrapf(ErrLimited, "too many records from %s", ip)
+		}
+	}
+	if !limits.Instance.Enabled() {
+		return nil
+	}
+	for instanceID, n := range recordsByInstance {
+		allowed, err := take(ctx, db, "instance:"+instanceID, limits.Instance, float64(n), now)
+		if err != nil {
+			return err
+		}
+		if !allowed {
+			return errors.Wrapf(ErrLimited, "too many records from instance %s", instanceID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestLimitsFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT_IP_PER_HOUR", "3600")
+	t.Setenv("RATE_LIMIT_IP_BURST", "")
+	t.Setenv("RATE_LIMIT_INSTANCE_PER_HOUR", "100")
+	t.Setenv("RATE_LIMIT_INSTANCE_BURST", "500")
+	limits, err := LimitsFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Limits{IP: Limit{Burst: 3600, PerHour: 3600}, Instance: Limit{Burst: 500, PerHour: 100}}
+	if limits != expected {
+		t.Fatalf("LimitsFromEnv = %+v, expected %+v", limits, expected)
+	}
+	t.Setenv("RATE_LIMIT_IP_BURST", "many")
+	if _, err := LimitsFromEnv(); err == nil {
+		t.Fatal("expected an error for an invalid burst")
+	}
+}
+
+// testDatabase returns a new database on the server at MONGODB_TEST_URI, dropped when the test ends.
+func testDatabase(t *testing.T) *mongo.Database {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+	ctx := context.Background()
+	mg, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := mg.Database(fmt.Sprintf("ratelimit_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		_ = db.Drop(context.Background())
+		_ = mg.Disconnect(context.Background())
+	})
+	return db
+}
+
+func tokens(t *testing.T, db *mongo.Database, key string) float64 {
+	t.Helper()
+	var bucket struct {
+		Tokens float64 `bson:"tokens"`
+	}
+	err := db.Collection(Collection).FindOne(context.Background(), bson.M{"_id": key}).Decode(&bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bucket.Tokens
+}
+
+func TestTakeRefillsAndGoesIntoDebt(t *testing.T) {
+	db := testDatabase(t)
+	// One token per second, up to 10.
+	limit := Limit{Burst: 10, PerHour: 3600}
+	start := time.Date(2023, 8, 1, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		name    string
+		elapsed time.Duration
+		cost    float64
+		allowed bool
+		tokens  float64
+	}{
+		{"new bucket is full", 0, 4, true, 6},
+		{"not enough tokens", 0, 7, false, 6},
+		{"refilled", time.Second, 7, true, 0},
+		{"refill is capped at the burst", time.Hour, 25, true, -15},
+		{"in debt", time.Hour + 10*time.Second, 1, false, -5},
+		{"debt repaid", time.Hour + 16*time.Second, 1, true, 0},
+		{"zero cost is allowed", time.Hour + 16*time.Second, 0, true, 0},
+	}
+	for _, step := range steps {
+		allowed, err := take(context.Background(), db, "ip:192.0.2.1", limit, step.cost, start.Add(step.elapsed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != step.allowed {
+			t.Fatalf("%s: allowed %t, expected %t", step.name, allowed, step.allowed)
+		}
+		if n := tokens(t, db, "ip:192.0.2.1"); n != step.tokens {
+			t.Fatalf("%s: %g tokens left, expected %g", step.name, n, step.tokens)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	limits := Limits{Instance: Limit{Burst: 100, PerHour: 100}}
+	if err := Allow(ctx, db, limits, "192.0.2.1", map[string]int{"a": 60, "b": 60}); err != nil {
+		t.Fatal(err)
+	}
+	err := Allow(ctx, db, limits, "192.0.2.1", map[string]int{"a": 60})
+	if !errors.Is(err, ErrLimited) {
+		t.Fatalf("expected ErrLimited, got %v", err)
+	}
+	// The IP limit is disabled, so another instance from the same IP is not limited.
+	if err := Allow(ctx, db, limits, "192.0.2.1", map[string]int{"c": 100}); err != nil {
+		t.Fatal(err)
+	}
+}
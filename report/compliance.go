@@ -0,0 +1,283 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// pieceBatchSize is the number of piece CIDs sent in a single $in query.
+const pieceBatchSize = 10000
+
+// markdownListLimit is the number of entries of a list shown in the Markdown rendering of a report.
+const markdownListLimit = 50
+
+type ReplicaCount struct {
+	Replicas int `json:"replicas"`
+	Pieces   int `json:"pieces"`
+}
+
+type ProviderShare struct {
+	Provider string  `json:"provider"`
+	Deals    int     `json:"deals"`
+	Bytes    int64   `json:"bytes"`
+	Share    float64 `json:"share"`
+}
+
+type DuplicatePiece struct {
+	PieceCID string `json:"pieceCid"`
+	Provider string `json:"provider"`
+	Deals    int    `json:"deals"`
+}
+
+type SharedPiece struct {
+	PieceCID string   `json:"pieceCid"`
+	Clients  []string `json:"clients"`
+}
+
+// ComplianceReport is the evidence allocators ask for about the active deals of a client.
+type ComplianceReport struct {
+	Client              string           `json:"client"`
+	Addresses           []string         `json:"addresses"`
+	GeneratedAt         time.Time        `json:"generatedAt"`
+	Deals               int              `json:"deals"`
+	Bytes               int64            `json:"bytes"`
+	Pieces              int              `json:"pieces"`
+	PieceBytes          int64            `json:"pieceBytes"`
+	MinReplicas         int              `json:"minReplicas"`
+	MaxReplicas         int              `json:"maxReplicas"`
+	AverageReplicas     float64          `json:"averageReplicas"`
+	ReplicaDistribution []ReplicaCount   `json:"replicaDistribution"`
+	Providers           []ProviderShare  `json:"providers"`
+	DuplicatePieces     []DuplicatePiece `json:"duplicatePieces"`
+	SharedPieces        []SharedPiece    `json:"sharedPieces"`
+}
+
+// clientAddresses returns the address together with the actor ID or account key it is mapped to.
+func clientAddresses(ctx context.Context, db *mongo.Database, address string) ([]string, error) {
+	var mapping model.ClientMapping
+	err := db.Collection("clients").FindOne(ctx, bson.M{"$or": bson.A{
+		bson.M{"actorId": address},
+		bson.M{"accountKey": address},
+	}}).Decode(&mapping)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return []string{address}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get client mapping")
+	}
+	return []string{mapping.ActorID, mapping.AccountKey}, nil
+}
+
+// Compliance builds the compliance report of the active deals of a client, given its actor ID or address.
+func Compliance(ctx context.Context, db *mongo.Database, client string) (*ComplianceReport, error) {
+	if client == "" {
+		return nil, errors.Wrap(ErrInvalidRequest, "client is required")
+	}
+	addresses, err := clientAddresses(ctx, db, client)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := db.Collection("deals").Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"client": bson.M{"$in": addresses}, "state": "active"}},
+		bson.M{"$group": bson.M{
+			"_id":       bson.M{"pieceCid": "$pieceCid", "provider": "$provider"},
+			"pieceSize": bson.M{"$first": "$pieceSize"},
+			"deals":     bson.M{"$sum": 1},
+		}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to aggregate client deals")
+	}
+	defer cursor.Close(ctx)
+	var rows []struct {
+		ID struct {
+			PieceCID string `bson:"pieceCid"`
+			Provider string `bson:"provider"`
+		} `bson:"_id"`
+		PieceSize int64 `bson:"pieceSize"`
+		Deals     int   `bson:"deals"`
+	}
+	err = cursor.All(ctx, &rows)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode client deals")
+	}
+	if len(rows) == 0 {
+		// A client without active deals gets an empty report, a client without any deal is unknown.
+		count, err := db.Collection("deals").CountDocuments(ctx, bson.M{"client": bson.M{"$in": addresses}},
+			options.Count().SetLimit(1))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to count client deals")
+		}
+		if count == 0 {
+			return nil, errors.Wrapf(ErrNotFound, "no deals of client %s", client)
+		}
+	}
+
+	report := &ComplianceReport{
+		Client:      client,
+		Addresses:   addresses,
+		GeneratedAt: time.Now().UTC(),
+	}
+	replicas := make(map[string]int)
+	providers := make(map[string]*ProviderShare)
+	for _, row := range rows {
+		report.Deals += row.Deals
+		report.Bytes += row.PieceSize * int64(row.Deals)
+		if _, ok := replicas[row.ID.PieceCID]; !ok {
+			report.PieceBytes += row.PieceSize
+		}
+		replicas[row.ID.PieceCID]++
+		p, ok := providers[row.ID.Provider]
+		if !ok {
+			p = &ProviderShare{Provider: row.ID.Provider}
+			providers[row.ID.Provider] = p
+		}
+		p.Deals += row.Deals
+		p.Bytes += row.PieceSize * int64(row.Deals)
+		if row.Deals > 1 {
+			report.DuplicatePieces = append(report.DuplicatePieces, DuplicatePiece{
+				PieceCID: row.ID.PieceCID,
+				Provider: row.ID.Provider,
+				Deals:    row.Deals,
+			})
+		}
+	}
+	report.Pieces = len(replicas)
+
+	distribution := make(map[int]int)
+	var totalReplicas int
+	for _, n := range replicas {
+		distribution[n]++
+		totalReplicas += n
+		if report.MinReplicas == 0 || n < report.MinReplicas {
+			report.MinReplicas = n
+		}
+		if n > report.MaxReplicas {
+			report.MaxReplicas = n
+		}
+	}
+	if report.Pieces > 0 {
+		report.AverageReplicas = float64(totalReplicas) / float64(report.Pieces)
+	}
+	for n, pieces := range distribution {
+		report.ReplicaDistribution = append(report.ReplicaDistribution, ReplicaCount{Replicas: n, Pieces: pieces})
+	}
+	sort.Slice(report.ReplicaDistribution, func(i, j int) bool {
+		return report.ReplicaDistribution[i].Replicas < report.ReplicaDistribution[j].Replicas
+	})
+	for _, p := range providers {
+		p.Share = share(p.Bytes, report.Bytes)
+		report.Providers = append(report.Providers, *p)
+	}
+	sort.Slice(report.Providers, func(i, j int) bool {
+		return report.Providers[i].Bytes > report.Providers[j].Bytes
+	})
+	sort.Slice(report.DuplicatePieces, func(i, j int) bool {
+		return report.DuplicatePieces[i].Deals > report.DuplicatePieces[j].Deals
+	})
+
+	pieceCIDs := make([]string, 0, len(replicas))
+	for pieceCID := range replicas {
+		pieceCIDs = append(pieceCIDs, pieceCID)
+	}
+	sort.Strings(pieceCIDs)
+	report.SharedPieces, err = sharedPieces(ctx, db, pieceCIDs, addresses)
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// sharedPieces finds the pieces that other clients also made active deals for.
+func sharedPieces(ctx context.Context, db *mongo.Database, pieceCIDs []string, addresses []string) ([]SharedPiece, error) {
+	var result []SharedPiece
+	for start := 0; start < len(pieceCIDs); start += pieceBatchSize {
+		end := start + pieceBatchSize
+		if end > len(pieceCIDs) {
+			end = len(pieceCIDs)
+		}
+		cursor, err := db.Collection("deals").Aggregate(ctx, bson.A{
+			bson.M{"$match": bson.M{
+				"pieceCid": bson.M{"$in": pieceCIDs[start:end]},
+				"client":   bson.M{"$nin": addresses},
+				"state":    "active",
+			}},
+			bson.M{"$group": bson.M{
+				"_id":     "$pieceCid",
+				"clients": bson.M{"$addToSet": "$client"},
+			}},
+			bson.M{"$sort": bson.M{"_id": 1}},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to aggregate shared pieces")
+		}
+		var rows []struct {
+			PieceCID string   `bson:"_id"`
+			Clients  []string `bson:"clients"`
+		}
+		err = cursor.All(ctx, &rows)
+		_ = cursor.Close(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode shared pieces")
+		}
+		for _, row := range rows {
+			sort.Strings(row.Clients)
+			result = append(result, SharedPiece{PieceCID: row.PieceCID, Clients: row.Clients})
+		}
+	}
+	return result, nil
+}
+
+func (r ComplianceReport) Markdown() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# Compliance report for %s\n\n", r.Client)
+	fmt.Fprintf(&sb, "Generated at %s from active deals of %s.\n\n", r.GeneratedAt.Format(time.RFC3339), strings.Join(r.Addresses, ", "))
+	fmt.Fprintf(&sb, "| Deals | Deal bytes | Unique pieces | Unique bytes | Min replicas | Avg replicas | Max replicas |\n")
+	fmt.Fprintf(&sb, "|---|---|---|---|---|---|---|\n")
+	fmt.Fprintf(&sb, "| %d | %d | %d | %d | %d | %.2f | %d |\n\n",
+		r.Deals, r.Bytes, r.Pieces, r.PieceBytes, r.MinReplicas, r.AverageReplicas, r.MaxReplicas)
+
+	fmt.Fprintf(&sb, "## Replicas per piece\n\n| Replicas | Pieces |\n|---|---|\n")
+	for _, c := range r.ReplicaDistribution {
+		fmt.Fprintf(&sb, "| %d | %d |\n", c.Replicas, c.Pieces)
+	}
+
+	fmt.Fprintf(&sb, "\n## Share of data per provider\n\n| Provider | Deals | Bytes | Share |\n|---|---|---|---|\n")
+	for _, p := range r.Providers {
+		fmt.Fprintf(&sb, "| %s | %d | %d | %s |\n", p.Provider, p.Deals, p.Bytes, formatShare(p.Share))
+	}
+
+	fmt.Fprintf(&sb, "\n## Duplicate pieces\n\n%d pieces are stored more than once with the same provider.\n\n", len(r.DuplicatePieces))
+	if len(r.DuplicatePieces) > 0 {
+		fmt.Fprintf(&sb, "| Piece CID | Provider | Deals |\n|---|---|---|\n")
+		for i, d := range r.DuplicatePieces {
+			if i == markdownListLimit {
+				fmt.Fprintf(&sb, "\n%d more not shown.\n", len(r.DuplicatePieces)-markdownListLimit)
+				break
+			}
+			fmt.Fprintf(&sb, "| %s | %s | %d |\n", d.PieceCID, d.Provider, d.Deals)
+		}
+	}
+
+	fmt.Fprintf(&sb, "\n## Pieces shared with other clients\n\n%d pieces also have active deals from other clients.\n\n", len(r.SharedPieces))
+	if len(r.SharedPieces) > 0 {
+		fmt.Fprintf(&sb, "| Piece CID | Clients |\n|---|---|\n")
+		for i, s := range r.SharedPieces {
+			if i == markdownListLimit {
+				fmt.Fprintf(&sb, "\n%d more not shown.\n", len(r.SharedPieces)-markdownListLimit)
+				break
+			}
+			fmt.Fprintf(&sb, "| %s | %s |\n", s.PieceCID, strings.Join(s.Clients, ", "))
+		}
+	}
+	return sb.String()
+}
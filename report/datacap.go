@@ -0,0 +1,249 @@
+package report
+
+import (
+	"context"
+	"sort"
+	"strconv"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// onboardedStates are the deal states of data that made it on chain.
+var onboardedStates = map[string]bool{
+	"active":  true,
+	"expired": true,
+	"slashed": true,
+}
+
+type ProviderUsage struct {
+	Provider string `json:"provider"`
+	Bytes    int64  `json:"bytes"`
+}
+
+type DatacapUsage struct {
+	ClientID    int32            `json:"clientId"`
+	AddressID   string           `json:"addressId"`
+	Address     string           `json:"address"`
+	Name        string           `json:"name"`
+	OrgName     string           `json:"orgName"`
+	Granted     int64            `json:"granted"`
+	UsedByState map[string]int64 `json:"usedByState"`
+	// Providers lists the onboarded bytes per provider, largest first.
+	Providers []ProviderUsage `json:"providers"`
+	// V1Bytes and V2Bytes are the onboarded bytes proposed through Singularity v1 and v2.
+	V1Bytes int64   `json:"v1Bytes"`
+	V2Bytes int64   `json:"v2Bytes"`
+	V1Share float64 `json:"v1Share"`
+	V2Share float64 `json:"v2Share"`
+}
+
+type DatacapReport struct {
+	Clients []DatacapUsage `json:"clients"`
+}
+
+func (r DatacapReport) Table() Table {
+	table := Table{Header: []string{"CLIENT", "NAME", "GRANTED", "ACTIVE", "EXPIRED", "SLASHED", "PROPOSED", "PROVIDERS", "V1", "V2"}}
+	for _, c := range r.Clients {
+		proposed := c.UsedByState["proposed"] + c.UsedByState["published"]
+		table.Rows = append(table.Rows, []string{
+			c.AddressID,
+			c.Name,
+			strconv.FormatInt(c.Granted, 10),
+			strconv.FormatInt(c.UsedByState["active"], 10),
+			strconv.FormatInt(c.UsedByState["expired"], 10),
+			strconv.FormatInt(c.UsedByState["slashed"], 10),
+			strconv.FormatInt(proposed, 10),
+			strconv.Itoa(len(c.Providers)),
+			formatShare(c.V1Share),
+			formatShare(c.V2Share),
+		})
+	}
+	return table
+}
+
+// grantedDatacap sums the allowances granted to a client, falling back to the initial allowance.
+func grantedDatacap(client model.VerifiedClient) int64 {
+	var total int64
+	for _, a := range client.Allowances {
+		v, err := strconv.ParseInt(a.Allowance, 10, 64)
+		if err == nil {
+			total += v
+		}
+	}
+	if total == 0 {
+		total, _ = strconv.ParseInt(client.InitialAllowance, 10, 64)
+	}
+	return total
+}
+
+// actorIDs maps every client address in ids to its actor ID, using the mappings stored by the client resolver.
+// Addresses without a mapping are mapped to themselves.
+func actorIDs(ctx context.Context, db *mongo.Database, ids []string) (map[string]string, error) {
+	result := make(map[string]string, len(ids))
+	for _, id := range ids {
+		result[id] = id
+	}
+	if len(ids) == 0 {
+		return result, nil
+	}
+	cursor, err := db.Collection("clients").Find(ctx, bson.M{"$or": bson.A{
+		bson.M{"actorId": bson.M{"$in": ids}},
+		bson.M{"accountKey": bson.M{"$in": ids}},
+	}})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get client mappings")
+	}
+	defer cursor.Close(ctx)
+	var mappings []model.ClientMapping
+	err = cursor.All(ctx, &mappings)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode client mappings")
+	}
+	for _, m := range mappings {
+		result[m.AccountKey] = m.ActorID
+	}
+	return result, nil
+}
+
+func verifiedClients(ctx context.Context, db *mongo.Database) ([]model.VerifiedClient, error) {
+	cursor, err := db.Collection("verifiedClients").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get verified clients")
+	}
+	defer cursor.Close(ctx)
+	var clients []model.VerifiedClient
+	err = cursor.All(ctx, &clients)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode verified clients")
+	}
+	return clients, nil
+}
+
+// Datacap reports, for each verified client with verified deals, the datacap it was granted and how much of it was
+// used by deal state and provider. If client is not empty, only the client with that actor ID or address is reported.
+func Datacap(ctx context.Context, db *mongo.Database, client string) (*DatacapReport, error) {
+	match := bson.M{"verified": true}
+	if client != "" {
+		addresses, err := clientAddresses(ctx, db, client)
+		if err != nil {
+			return nil, err
+		}
+		match["client"] = bson.M{"$in": addresses}
+	}
+	cursor, err := db.Collection("deals").Aggregate(ctx, bson.A{
+		bson.M{"$match": match},
+		bson.M{"$group": bson.M{
+			"_id": bson.M{
+				"client":   "$client",
+				"state":    "$state",
+				"provider": "$provider",
+				"isV1":     "$isV1",
+			},
+			"bytes": bson.M{"$sum": "$pieceSize"},
+		}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to aggregate verified deals")
+	}
+	defer cursor.Close(ctx)
+	var rows []struct {
+		ID struct {
+			Client   string `bson:"client"`
+			State    string `bson:"state"`
+			Provider string `bson:"provider"`
+			IsV1     bool   `bson:"isV1"`
+		} `bson:"_id"`
+		Bytes int64 `bson:"bytes"`
+	}
+	err = cursor.All(ctx, &rows)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode verified deals")
+	}
+
+	dealClientSet := make(map[string]struct{})
+	for _, row := range rows {
+		dealClientSet[row.ID.Client] = struct{}{}
+	}
+	dealClients := make([]string, 0, len(dealClientSet))
+	for c := range dealClientSet {
+		dealClients = append(dealClients, c)
+	}
+	actors, err := actorIDs(ctx, db, dealClients)
+	if err != nil {
+		return nil, err
+	}
+
+	vClients, err := verifiedClients(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	byAddress := make(map[string]*model.VerifiedClient)
+	for i := range vClients {
+		v := &vClients[i]
+		if client != "" && v.AddressID != client && v.Address != client {
+			continue
+		}
+		if v.AddressID != "" {
+			byAddress[v.AddressID] = v
+		}
+		if v.Address != "" {
+			byAddress[v.Address] = v
+		}
+	}
+
+	usages := make(map[int32]*DatacapUsage)
+	providers := make(map[int32]map[string]int64)
+	for _, row := range rows {
+		v, ok := byAddress[actors[row.ID.Client]]
+		if !ok {
+			v, ok = byAddress[row.ID.Client]
+		}
+		if !ok {
+			continue
+		}
+		usage, ok := usages[v.ID]
+		if !ok {
+			usage = &DatacapUsage{
+				ClientID:    v.ID,
+				AddressID:   v.AddressID,
+				Address:     v.Address,
+				Name:        v.Name,
+				OrgName:     v.OrgName,
+				Granted:     grantedDatacap(*v),
+				UsedByState: make(map[string]int64),
+			}
+			usages[v.ID] = usage
+			providers[v.ID] = make(map[string]int64)
+		}
+		usage.UsedByState[row.ID.State] += row.Bytes
+		if !onboardedStates[row.ID.State] {
+			continue
+		}
+		providers[v.ID][row.ID.Provider] += row.Bytes
+		if row.ID.IsV1 {
+			usage.V1Bytes += row.Bytes
+		} else {
+			usage.V2Bytes += row.Bytes
+		}
+	}
+
+	report := &DatacapReport{Clients: make([]DatacapUsage, 0, len(usages))}
+	for id, usage := range usages {
+		for provider, bytes := range providers[id] {
+			usage.Providers = append(usage.Providers, ProviderUsage{Provider: provider, Bytes: bytes})
+		}
+		sort.Slice(usage.Providers, func(i, j int) bool {
+			return usage.Providers[i].Bytes > usage.Providers[j].Bytes
+		})
+		usage.V1Share = share(usage.V1Bytes, usage.V1Bytes+usage.V2Bytes)
+		usage.V2Share = share(usage.V2Bytes, usage.V1Bytes+usage.V2Bytes)
+		report.Clients = append(report.Clients, *usage)
+	}
+	sort.Slice(report.Clients, func(i, j int) bool {
+		return report.Clients[i].Granted > report.Clients[j].Granted
+	})
+	return report, nil
+}
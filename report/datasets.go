@@ -0,0 +1,74 @@
+package report
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/dataset"
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type DatasetsReport struct {
+	Datasets []model.Dataset `json:"datasets"`
+}
+
+func (r DatasetsReport) Table() Table {
+	table := Table{Header: []string{"REPORTER", "DATASET ID", "DATASET", "V1", "CARS", "BYTES", "PIECES", "ACTIVE PIECES", "REPLICAS", "LAST SEEN"}}
+	for _, d := range r.Datasets {
+		table.Rows = append(table.Rows, []string{
+			d.Key.Reporter,
+			strconv.FormatUint(uint64(d.Key.DatasetID), 10),
+			d.Key.DatasetName,
+			strconv.FormatBool(d.IsV1),
+			strconv.FormatInt(d.Cars, 10),
+			strconv.FormatInt(d.Bytes, 10),
+			strconv.FormatInt(d.Pieces, 10),
+			strconv.FormatInt(d.ActivePieces, 10),
+			strconv.FormatInt(d.Replicas, 10),
+			d.LastSeenAt.Format(time.RFC3339),
+		})
+	}
+	return table
+}
+
+type DatasetProgressReport struct {
+	Key      model.DatasetKey        `json:"key"`
+	Since    time.Time               `json:"since"`
+	Progress []model.DatasetProgress `json:"progress"`
+}
+
+func (r DatasetProgressReport) Table() Table {
+	table := Table{Header: []string{"AT", "CARS", "BYTES", "PIECES", "ACTIVE PIECES", "REPLICAS"}}
+	for _, p := range r.Progress {
+		table.Rows = append(table.Rows, []string{
+			p.At.Format(time.RFC3339),
+			strconv.FormatInt(p.Cars, 10),
+			strconv.FormatInt(p.Bytes, 10),
+			strconv.FormatInt(p.Pieces, 10),
+			strconv.FormatInt(p.ActivePieces, 10),
+			strconv.FormatInt(p.Replicas, 10),
+		})
+	}
+	return table
+}
+
+// Datasets lists every dataset with the totals of its last refresh. Only v1 instances report the dataset of a car,
+// so the cars prepared by v2 instances are not part of any dataset.
+func Datasets(ctx context.Context, db *mongo.Database) (*DatasetsReport, error) {
+	datasets, err := dataset.List(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return &DatasetsReport{Datasets: datasets}, nil
+}
+
+// DatasetProgress returns the progress snapshots of a dataset since the given time.
+func DatasetProgress(ctx context.Context, db *mongo.Database, key model.DatasetKey, since time.Time) (*DatasetProgressReport, error) {
+	progress, err := dataset.Progress(ctx, db, key, since)
+	if err != nil {
+		return nil, err
+	}
+	return &DatasetProgressReport{Key: key, Since: since, Progress: progress}, nil
+}
@@ -0,0 +1,10 @@
+package report
+
+import "github.com/pkg/errors"
+
+var (
+	// ErrInvalidRequest is the cause of the errors returned for invalid report parameters.
+	ErrInvalidRequest = errors.New("invalid request")
+	// ErrNotFound is the cause of the errors returned when the subject of a report is unknown.
+	ErrNotFound = errors.New("not found")
+)
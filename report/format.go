@@ -0,0 +1,68 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// Table is the text rendering of a report.
+type Table struct {
+	Header []string
+	Rows   [][]string
+}
+
+type Tabular interface {
+	Table() Table
+}
+
+type Markdowner interface {
+	Markdown() string
+}
+
+// Write renders a report as "json", or as a "text" table or "markdown" document if the report supports it.
+// Reports that cannot be rendered as a table are rendered as markdown for "text".
+func Write(w io.Writer, format string, v any) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return errors.Wrap(encoder.Encode(v), "failed to encode report")
+	case "text":
+		tabular, ok := v.(Tabular)
+		if !ok {
+			return Write(w, "markdown", v)
+		}
+		table := tabular.Table()
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(table.Header, "\t"))
+		for _, row := range table.Rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return errors.Wrap(tw.Flush(), "failed to write report")
+	case "markdown":
+		markdowner, ok := v.(Markdowner)
+		if !ok {
+			return errors.Errorf("report %T cannot be rendered as markdown", v)
+		}
+		_, err := io.WriteString(w, markdowner.Markdown())
+		return errors.Wrap(err, "failed to write report")
+	default:
+		return errors.Errorf("unknown report format %q", format)
+	}
+}
+
+func share(part int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
+
+func formatShare(v float64) string {
+	return fmt.Sprintf("%.1f%%", v*100)
+}
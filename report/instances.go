@@ -0,0 +1,66 @@
+package report
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/instance"
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DefaultQuietDays is how long an instance has to go without reporting to be considered quiet.
+const DefaultQuietDays = 7
+
+type InstancesReport struct {
+	// QuietSince is set when the report only lists instances that have not reported since then.
+	QuietSince *time.Time       `json:"quietSince,omitempty"`
+	Instances  []model.Instance `json:"instances"`
+}
+
+func (r InstancesReport) Table() Table {
+	table := Table{Header: []string{"INSTANCE", "PROTOCOL", "IDENTITY", "IPS", "CARS", "DEALS", "FIRST SEEN", "LAST SEEN"}}
+	for _, i := range r.Instances {
+		protocol := "v2"
+		if i.IsV1 {
+			protocol = "v1"
+		}
+		table.Rows = append(table.Rows, []string{
+			i.InstanceID,
+			protocol,
+			i.Identity,
+			strings.Join(i.IPs, ","),
+			strconv.FormatInt(i.Cars, 10),
+			strconv.FormatInt(i.Deals, 10),
+			i.FirstSeenAt.Format(time.RFC3339),
+			i.LastSeenAt.Format(time.RFC3339),
+		})
+	}
+	return table
+}
+
+// Instances lists the instances matching the filter.
+func Instances(ctx context.Context, db *mongo.Database, filter instance.Filter) (*InstancesReport, error) {
+	instances, err := instance.List(ctx, db, filter)
+	if err != nil {
+		return nil, err
+	}
+	return &InstancesReport{Instances: instances}, nil
+}
+
+// QuietInstances lists the instances that have not reported anything in the given number of days,
+// longest quiet last.
+func QuietInstances(ctx context.Context, db *mongo.Database, days int) (*InstancesReport, error) {
+	if days < 1 {
+		return nil, errors.Wrap(ErrInvalidRequest, "days must be positive")
+	}
+	quietSince := time.Now().UTC().AddDate(0, 0, -days)
+	instances, err := instance.List(ctx, db, instance.Filter{QuietSince: quietSince})
+	if err != nil {
+		return nil, err
+	}
+	return &InstancesReport{QuietSince: &quietSince, Instances: instances}, nil
+}
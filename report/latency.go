@@ -0,0 +1,180 @@
+package report
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultLatencyOptions are used by the report command and API when no options are given.
+var DefaultLatencyOptions = LatencyOptions{By: "provider", Days: 90}
+
+type LatencyOptions struct {
+	// By is the deal field the deals are grouped by, "provider" or "client".
+	By string
+	// Days is how far back to look for proposals.
+	Days     int
+	Provider string
+	Client   string
+}
+
+// Percentiles of a latency distribution, in hours.
+type Percentiles struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50Hours"`
+	P90   float64 `json:"p90Hours"`
+	P99   float64 `json:"p99Hours"`
+}
+
+type DealLatency struct {
+	Key       string `json:"key"`
+	Proposals int64  `json:"proposals"`
+	// MissedStart is the number of proposals whose start epoch passed before they were activated.
+	MissedStart     int64       `json:"missedStart"`
+	FailureRate     float64     `json:"failureRate"`
+	ToPublish       Percentiles `json:"toPublish"`
+	ToActivation    Percentiles `json:"toActivation"`
+	publishHours    []float64
+	activationHours []float64
+}
+
+type LatencyReport struct {
+	By    string        `json:"by"`
+	Since time.Time     `json:"since"`
+	Rows  []DealLatency `json:"rows"`
+}
+
+func formatHours(v float64) string {
+	return strconv.FormatFloat(v, 'f', 1, 64)
+}
+
+func (r LatencyReport) Table() Table {
+	table := Table{Header: []string{
+		"KEY", "PROPOSALS", "MISSED START", "FAILURE RATE",
+		"PUBLISH P50", "PUBLISH P90", "PUBLISH P99",
+		"ACTIVATION P50", "ACTIVATION P90", "ACTIVATION P99",
+	}}
+	for _, row := range r.Rows {
+		table.Rows = append(table.Rows, []string{
+			row.Key,
+			strconv.FormatInt(row.Proposals, 10),
+			strconv.FormatInt(row.MissedStart, 10),
+			formatShare(row.FailureRate),
+			formatHours(row.ToPublish.P50),
+			formatHours(row.ToPublish.P90),
+			formatHours(row.ToPublish.P99),
+			formatHours(row.ToActivation.P50),
+			formatHours(row.ToActivation.P90),
+			formatHours(row.ToActivation.P99),
+		})
+	}
+	return table
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func percentiles(values []float64) Percentiles {
+	sort.Float64s(values)
+	return Percentiles{
+		Count: len(values),
+		P50:   percentile(values, 50),
+		P90:   percentile(values, 90),
+		P99:   percentile(values, 99),
+	}
+}
+
+// Latency reports how long deals proposed through Singularity take to be published and activated, grouped by
+// provider or client. Deals found on chain without a proposal are left out since their proposal time is unknown.
+// Publish times are observed by the deal sync, so they are late by up to its interval.
+func Latency(ctx context.Context, db *mongo.Database, opts LatencyOptions) (*LatencyReport, error) {
+	if opts.By != "provider" && opts.By != "client" {
+		return nil, errors.Wrapf(ErrInvalidRequest, "unknown grouping %q", opts.By)
+	}
+	if opts.Days < 1 {
+		return nil, errors.Wrap(ErrInvalidRequest, "days must be positive")
+	}
+	now := time.Now().UTC()
+	since := now.AddDate(0, 0, -opts.Days)
+	currentEpoch := model.TimeToEpoch(now)
+	filter := bson.M{"instanceId": bson.M{"$ne": "external"}, "createdAt": bson.M{"$gte": since}}
+	if opts.Provider != "" {
+		filter["provider"] = opts.Provider
+	}
+	if opts.Client != "" {
+		filter["client"] = opts.Client
+	}
+	cursor, err := db.Collection("deals").Find(ctx, filter, options.Find().SetProjection(bson.M{
+		"client": 1, "provider": 1, "state": 1, "createdAt": 1, "publishedAt": 1, "startEpoch": 1, "sectorStartEpoch": 1,
+	}))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get deals")
+	}
+	defer cursor.Close(ctx)
+
+	rows := make(map[string]*DealLatency)
+	for cursor.Next(ctx) {
+		var deal model.Deal
+		err = cursor.Decode(&deal)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode deal")
+		}
+		key := deal.Provider
+		if opts.By == "client" {
+			key = deal.Client
+		}
+		row, ok := rows[key]
+		if !ok {
+			row = &DealLatency{Key: key}
+			rows[key] = row
+		}
+		row.Proposals++
+		if deal.PublishedAt != nil && deal.PublishedAt.After(deal.CreatedAt) {
+			row.publishHours = append(row.publishHours, deal.PublishedAt.Sub(deal.CreatedAt).Hours())
+		}
+		activated := deal.SectorStartEpoch != nil && *deal.SectorStartEpoch > 0
+		if activated {
+			if activatedAt := model.EpochToTime(*deal.SectorStartEpoch); activatedAt.After(deal.CreatedAt) {
+				row.activationHours = append(row.activationHours, activatedAt.Sub(deal.CreatedAt).Hours())
+			}
+		}
+		if !activated && deal.State != "slashed" && deal.StartEpoch != nil && *deal.StartEpoch > 0 && *deal.StartEpoch < currentEpoch {
+			row.MissedStart++
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate deals")
+	}
+
+	report := &LatencyReport{By: opts.By, Since: since}
+	for _, row := range rows {
+		row.FailureRate = share(row.MissedStart, row.Proposals)
+		row.ToPublish = percentiles(row.publishHours)
+		row.ToActivation = percentiles(row.activationHours)
+		report.Rows = append(report.Rows, *row)
+	}
+	sort.Slice(report.Rows, func(i, j int) bool {
+		if report.Rows[i].Proposals != report.Rows[j].Proposals {
+			return report.Rows[i].Proposals > report.Rows[j].Proposals
+		}
+		return report.Rows[i].Key < report.Rows[j].Key
+	})
+	return report, nil
+}
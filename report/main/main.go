@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/instance"
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/data-preservation-programs/singularity-metrics/report"
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// withDatabase connects to the metrics database for the duration of a command.
+func withDatabase(c *cli.Context, f func(db *mongo.Database) (any, error)) error {
+	mg, err := mongo.Connect(c.Context, options.Client().ApplyURI(c.String("mongodb-uri")))
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to mongo")
+	}
+	defer func() {
+		_ = mg.Disconnect(context.Background())
+	}()
+	result, err := f(mg.Database("singularity"))
+	if err != nil {
+		return err
+	}
+	return report.Write(os.Stdout, c.String("format"), result)
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app := &cli.App{
+		Name:  "report",
+		Usage: "Generate reports from the metrics database",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "mongodb-uri",
+				Usage:   "MongoDB connection string",
+				EnvVars: []string{"MONGODB_URI"},
+			},
+			&cli.StringFlag{
+				Name:  "format",
+				Usage: "Output format, text, markdown or json",
+				Value: "text",
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "datacap",
+				Usage: "Datacap granted to and used by each verified client",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "client", Usage: "Only report the client with this actor ID or address"},
+				},
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(db *mongo.Database) (any, error) {
+						return report.Datacap(c.Context, db, c.String("client"))
+					})
+				},
+			},
+			{
+				Name:      "compliance",
+				Usage:     "Fil+ compliance evidence for the active deals of a client",
+				ArgsUsage: "<client address>",
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(db *mongo.Database) (any, error) {
+						return report.Compliance(c.Context, db, c.Args().First())
+					})
+				},
+			},
+			{
+				Name:  "replication",
+				Usage: "Pieces that have or will soon have fewer active replicas than the target",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "target", Usage: "Target number of distinct providers per piece", Value: report.DefaultReplicationOptions.TargetReplicas},
+					&cli.IntFlag{Name: "days", Usage: "Number of days to look ahead for expiring deals", Value: report.DefaultReplicationOptions.Days},
+				},
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(db *mongo.Database) (any, error) {
+						return report.Replication(c.Context, db, report.ReplicationOptions{
+							TargetReplicas: c.Int("target"),
+							Days:           c.Int("days"),
+						})
+					})
+				},
+			},
+			{
+				Name:  "latency",
+				Usage: "Time from proposal to publish and activation, and missed start epochs, per provider or client",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "by", Usage: "Group deals by provider or client", Value: report.DefaultLatencyOptions.By},
+					&cli.IntFlag{Name: "days", Usage: "Number of days to look back for proposals", Value: report.DefaultLatencyOptions.Days},
+					&cli.StringFlag{Name: "provider", Usage: "Only report deals with this provider"},
+					&cli.StringFlag{Name: "client", Usage: "Only report deals with this client"},
+				},
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(db *mongo.Database) (any, error) {
+						return report.Latency(c.Context, db, report.LatencyOptions{
+							By:       c.String("by"),
+							Days:     c.Int("days"),
+							Provider: c.String("provider"),
+							Client:   c.String("client"),
+						})
+					})
+				},
+			},
+			{
+				Name:  "scorecard",
+				Usage: "Reliability scorecard of each provider over a rolling window",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "window", Usage: "Window in days, 7, 30 or 90", Value: report.DefaultScorecardWindow},
+					&cli.StringFlag{Name: "provider", Usage: "Only report this provider"},
+				},
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(db *mongo.Database) (any, error) {
+						return report.Scorecard(c.Context, db, c.Int("window"), c.String("provider"))
+					})
+				},
+			},
+			{
+				Name:  "stranded",
+				Usage: "Packed pieces that never got a deal or whose deals all failed",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "min-age", Usage: "Only report pieces packed at least this many days ago", Value: report.DefaultStrandedOptions.MinAgeDays},
+					&cli.IntFlag{Name: "max-age", Usage: "Only report pieces packed at most this many days ago, 0 for no limit"},
+				},
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(db *mongo.Database) (any, error) {
+						return report.Stranded(c.Context, db, report.StrandedOptions{
+							MinAgeDays: c.Int("min-age"),
+							MaxAgeDays: c.Int("max-age"),
+						})
+					})
+				},
+			},
+			{
+				Name:  "datasets",
+				Usage: "Datasets prepared by v1 instances with their prepared and onboarded totals",
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(db *mongo.Database) (any, error) {
+						return report.Datasets(c.Context, db)
+					})
+				},
+			},
+			{
+				Name:  "dataset-progress",
+				Usage: "Onboarding progress of a dataset over time",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "reporter", Usage: "Identity or instance ID of the reporter that prepared the dataset", Required: true},
+					&cli.UintFlag{Name: "dataset-id", Usage: "Dataset ID, for v1 datasets"},
+					&cli.StringFlag{Name: "dataset-name", Usage: "Dataset name"},
+					&cli.TimestampFlag{Name: "since", Usage: "Only report progress since this time", Layout: time.RFC3339},
+				},
+				Action: func(c *cli.Context) error {
+					since := time.Now().AddDate(0, 0, -30)
+					if t := c.Timestamp("since"); t != nil {
+						since = *t
+					}
+					key := model.DatasetKey{
+						Reporter:    c.String("reporter"),
+						DatasetID:   uint32(c.Uint("dataset-id")),
+						DatasetName: c.String("dataset-name"),
+					}
+					return withDatabase(c, func(db *mongo.Database) (any, error) {
+						return report.DatasetProgress(c.Context, db, key, since)
+					})
+				},
+			},
+			{
+				Name:  "instances",
+				Usage: "Singularity instances that have reported metrics",
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "protocol", Usage: "Only list v1 or v2 instances"},
+					&cli.StringFlag{Name: "identity", Usage: "Only list instances with this identity"},
+					&cli.StringFlag{Name: "ip", Usage: "Only list instances that reported from this IP"},
+					&cli.TimestampFlag{Name: "seen-since", Usage: "Only list instances seen since this time", Layout: time.RFC3339},
+				},
+				Action: func(c *cli.Context) error {
+					filter := instance.Filter{Identity: c.String("identity"), IP: c.String("ip")}
+					switch c.String("protocol") {
+					case "":
+					case "v1", "v2":
+						isV1 := c.String("protocol") == "v1"
+						filter.IsV1 = &isV1
+					default:
+						return errors.Errorf("unknown protocol %q", c.String("protocol"))
+					}
+					if t := c.Timestamp("seen-since"); t != nil {
+						filter.SeenSince = *t
+					}
+					return withDatabase(c, func(db *mongo.Database) (any, error) {
+						return report.Instances(c.Context, db, filter)
+					})
+				},
+			},
+			{
+				Name:  "quiet-instances",
+				Usage: "Instances that have stopped reporting",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "days", Usage: "Number of days without a report", Value: report.DefaultQuietDays},
+				},
+				Action: func(c *cli.Context) error {
+					return withDatabase(c, func(db *mongo.Database) (any, error) {
+						return report.QuietInstances(c.Context, db, c.Int("days"))
+					})
+				},
+			},
+		},
+	}
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		panic(err)
+	}
+}
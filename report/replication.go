@@ -0,0 +1,235 @@
+package report
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultReplicationOptions are used by the report command and API when no options are given.
+var DefaultReplicationOptions = ReplicationOptions{TargetReplicas: 4, Days: 30}
+
+type ReplicationOptions struct {
+	// TargetReplicas is the number of distinct providers each piece should have an active deal with.
+	TargetReplicas int
+	// Days is how far ahead to look for deals reaching their end epoch.
+	Days int
+}
+
+type AtRiskPiece struct {
+	PieceCID string `json:"pieceCid"`
+	// Replicas is the number of distinct providers with an active deal for the piece today.
+	Replicas int `json:"replicas"`
+	// ReplicasAtHorizon is the number of those providers whose deals are still active at the end of the window.
+	ReplicasAtHorizon int `json:"replicasAtHorizon"`
+	Slashed           int `json:"slashed"`
+	// BelowTargetAt is when the piece drops below the target replica count, or now if it already has.
+	BelowTargetAt time.Time `json:"belowTargetAt"`
+}
+
+type DatasetReplication struct {
+	DatasetName string        `json:"datasetName"`
+	InstanceID  string        `json:"instanceId"`
+	Pieces      []AtRiskPiece `json:"pieces"`
+}
+
+type ReplicationReport struct {
+	TargetReplicas int                  `json:"targetReplicas"`
+	Horizon        time.Time            `json:"horizon"`
+	Datasets       []DatasetReplication `json:"datasets"`
+}
+
+func (r ReplicationReport) Table() Table {
+	table := Table{Header: []string{"DATASET", "INSTANCE", "PIECE", "REPLICAS", "AT HORIZON", "SLASHED", "BELOW TARGET AT"}}
+	for _, d := range r.Datasets {
+		for _, p := range d.Pieces {
+			table.Rows = append(table.Rows, []string{
+				d.DatasetName,
+				d.InstanceID,
+				p.PieceCID,
+				strconv.Itoa(p.Replicas),
+				strconv.Itoa(p.ReplicasAtHorizon),
+				strconv.Itoa(p.Slashed),
+				p.BelowTargetAt.Format(time.RFC3339),
+			})
+		}
+	}
+	return table
+}
+
+type carPiece struct {
+	PieceCID    string
+	DatasetName string
+	InstanceID  string
+}
+
+type pieceDeals struct {
+	// endEpochs holds the latest end epoch of the active deals with each provider.
+	endEpochs map[string]int32
+	slashed   int
+}
+
+func activeDealsOfPieces(ctx context.Context, db *mongo.Database, pieceCIDs []string) (map[string]*pieceDeals, error) {
+	cursor, err := db.Collection("deals").Find(ctx, bson.M{
+		"pieceCid": bson.M{"$in": pieceCIDs},
+		"state":    bson.M{"$in": bson.A{"active", "slashed"}},
+	}, options.Find().SetProjection(bson.M{"pieceCid": 1, "provider": 1, "state": 1, "endEpoch": 1}))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get deals")
+	}
+	defer cursor.Close(ctx)
+	result := make(map[string]*pieceDeals)
+	for cursor.Next(ctx) {
+		var deal model.Deal
+		err = cursor.Decode(&deal)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode deal")
+		}
+		p, ok := result[deal.PieceCID]
+		if !ok {
+			p = &pieceDeals{endEpochs: make(map[string]int32)}
+			result[deal.PieceCID] = p
+		}
+		if deal.State == "slashed" {
+			p.slashed++
+			continue
+		}
+		var endEpoch int32
+		if deal.EndEpoch != nil {
+			endEpoch = *deal.EndEpoch
+		}
+		if endEpoch > p.endEpochs[deal.Provider] {
+			p.endEpochs[deal.Provider] = endEpoch
+		}
+	}
+	return result, errors.Wrap(cursor.Err(), "failed to iterate deals")
+}
+
+// assess returns the piece if it has fewer than target replicas before the horizon epoch.
+func assess(pieceCID string, deals *pieceDeals, target int, horizon int32, now time.Time) (AtRiskPiece, bool) {
+	piece := AtRiskPiece{PieceCID: pieceCID, BelowTargetAt: now}
+	var endEpochs []int32
+	if deals != nil {
+		piece.Slashed = deals.slashed
+		for _, e := range deals.endEpochs {
+			endEpochs = append(endEpochs, e)
+			if e >= horizon {
+				piece.ReplicasAtHorizon++
+			}
+		}
+	}
+	piece.Replicas = len(endEpochs)
+	if piece.ReplicasAtHorizon >= target {
+		return AtRiskPiece{}, false
+	}
+	if piece.Replicas >= target {
+		// The piece keeps the target until the target-th latest deal ends.
+		sort.Slice(endEpochs, func(i, j int) bool { return endEpochs[i] > endEpochs[j] })
+		piece.BelowTargetAt = model.EpochToTime(endEpochs[target-1])
+	}
+	return piece, true
+}
+
+// Replication finds the pieces in cars that have, or will have within the given number of days, active deals
+// with fewer distinct providers than the target. Pieces are grouped by dataset and instance, and both the pieces
+// and the groups are ranked by when they drop below the target.
+func Replication(ctx context.Context, db *mongo.Database, opts ReplicationOptions) (*ReplicationReport, error) {
+	if opts.TargetReplicas < 1 {
+		return nil, errors.Wrap(ErrInvalidRequest, "target replicas must be positive")
+	}
+	now := time.Now().UTC()
+	horizonTime := now.Add(time.Duration(opts.Days) * 24 * time.Hour)
+	horizon := model.TimeToEpoch(horizonTime)
+
+	cursor, err := db.Collection("cars").Aggregate(ctx, bson.A{
+		bson.M{"$group": bson.M{"_id": bson.M{
+			"pieceCid":    "$pieceCid",
+			"datasetName": "$datasetName",
+			"instanceId":  "$instanceId",
+		}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to aggregate cars")
+	}
+	defer cursor.Close(ctx)
+
+	groups := make(map[[2]string]*DatasetReplication)
+	var batch []carPiece
+	flush := func() error {
+		pieceCIDs := make([]string, 0, len(batch))
+		for _, c := range batch {
+			pieceCIDs = append(pieceCIDs, c.PieceCID)
+		}
+		deals, err := activeDealsOfPieces(ctx, db, pieceCIDs)
+		if err != nil {
+			return err
+		}
+		for _, c := range batch {
+			piece, atRisk := assess(c.PieceCID, deals[c.PieceCID], opts.TargetReplicas, horizon, now)
+			if !atRisk {
+				continue
+			}
+			key := [2]string{c.DatasetName, c.InstanceID}
+			group, ok := groups[key]
+			if !ok {
+				group = &DatasetReplication{DatasetName: c.DatasetName, InstanceID: c.InstanceID}
+				groups[key] = group
+			}
+			group.Pieces = append(group.Pieces, piece)
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				PieceCID    string `bson:"pieceCid"`
+				DatasetName string `bson:"datasetName"`
+				InstanceID  string `bson:"instanceId"`
+			} `bson:"_id"`
+		}
+		err = cursor.Decode(&row)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode car")
+		}
+		batch = append(batch, carPiece(row.ID))
+		if len(batch) >= pieceBatchSize {
+			err = flush()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate cars")
+	}
+	if len(batch) > 0 {
+		err = flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report := &ReplicationReport{TargetReplicas: opts.TargetReplicas, Horizon: horizonTime}
+	for _, group := range groups {
+		sort.Slice(group.Pieces, func(i, j int) bool {
+			return group.Pieces[i].BelowTargetAt.Before(group.Pieces[j].BelowTargetAt)
+		})
+		report.Datasets = append(report.Datasets, *group)
+	}
+	sort.Slice(report.Datasets, func(i, j int) bool {
+		a, b := report.Datasets[i], report.Datasets[j]
+		if !a.Pieces[0].BelowTargetAt.Equal(b.Pieces[0].BelowTargetAt) {
+			return a.Pieces[0].BelowTargetAt.Before(b.Pieces[0].BelowTargetAt)
+		}
+		return len(a.Pieces) > len(b.Pieces)
+	})
+	return report, nil
+}
@@ -0,0 +1,58 @@
+package report
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/data-preservation-programs/singularity-metrics/scorecard"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// DefaultScorecardWindow is the window, in days, reported when none is given.
+const DefaultScorecardWindow = 30
+
+type ScorecardReport struct {
+	WindowDays int                       `json:"windowDays"`
+	Providers  []model.ProviderScorecard `json:"providers"`
+}
+
+func (r ScorecardReport) Table() Table {
+	table := Table{Header: []string{"PROVIDER", "PROPOSALS", "ACCEPTED", "ACTIVATED", "PROPOSAL EXPIRED", "SLASHED", "AVG PRICE", "VERIFIED", "COMPUTED AT"}}
+	for _, s := range r.Providers {
+		price := "-"
+		if s.AveragePrice != nil {
+			price = strconv.FormatFloat(*s.AveragePrice, 'g', 4, 64)
+		}
+		table.Rows = append(table.Rows, []string{
+			s.Key.Provider,
+			strconv.FormatInt(s.Proposals, 10),
+			formatShare(s.AcceptanceRate),
+			formatShare(s.ActivationRate),
+			formatShare(s.ProposalExpiredRate),
+			formatShare(s.SlashingRate),
+			price,
+			formatShare(s.VerifiedRatio),
+			s.ComputedAt.Format(time.RFC3339),
+		})
+	}
+	return table
+}
+
+// Scorecard returns the provider scorecards last materialized for the given window.
+func Scorecard(ctx context.Context, db *mongo.Database, windowDays int, provider string) (*ScorecardReport, error) {
+	known := false
+	for _, w := range scorecard.Windows {
+		known = known || w == windowDays
+	}
+	if !known {
+		return nil, errors.Wrapf(ErrInvalidRequest, "no scorecards are computed for a %d day window", windowDays)
+	}
+	scorecards, err := scorecard.List(ctx, db, windowDays, provider)
+	if err != nil {
+		return nil, err
+	}
+	return &ScorecardReport{WindowDays: windowDays, Providers: scorecards}, nil
+}
@@ -0,0 +1,226 @@
+package report
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DefaultStrandedOptions are used by the report command and API when no options are given.
+var DefaultStrandedOptions = StrandedOptions{MinAgeDays: 7}
+
+type StrandedOptions struct {
+	// MinAgeDays leaves out pieces packed more recently, since they may not have been dealt yet.
+	MinAgeDays int
+	// MaxAgeDays leaves out pieces packed longer ago, if positive.
+	MaxAgeDays int
+}
+
+type StrandedPiece struct {
+	PieceCID  string    `json:"pieceCid"`
+	PieceSize int64     `json:"pieceSize"`
+	Bytes     int64     `json:"bytes"`
+	PackedAt  time.Time `json:"packedAt"`
+	// Deals is the number of deals made for the piece, none of which succeeded.
+	Deals int `json:"deals"`
+}
+
+type StrandedDataset struct {
+	InstanceID  string          `json:"instanceId"`
+	DatasetName string          `json:"datasetName"`
+	Undealt     int             `json:"undealt"`
+	Failed      int             `json:"failed"`
+	Bytes       int64           `json:"bytes"`
+	Pieces      []StrandedPiece `json:"pieces"`
+}
+
+type StrandedReport struct {
+	MinAgeDays int               `json:"minAgeDays"`
+	MaxAgeDays int               `json:"maxAgeDays,omitempty"`
+	Undealt    int               `json:"undealt"`
+	Failed     int               `json:"failed"`
+	Bytes      int64             `json:"bytes"`
+	Datasets   []StrandedDataset `json:"datasets"`
+}
+
+func (r StrandedReport) Table() Table {
+	table := Table{Header: []string{"INSTANCE", "DATASET", "PIECE", "PIECE SIZE", "BYTES", "PACKED AT", "DEALS"}}
+	for _, d := range r.Datasets {
+		for _, p := range d.Pieces {
+			table.Rows = append(table.Rows, []string{
+				d.InstanceID,
+				d.DatasetName,
+				p.PieceCID,
+				strconv.FormatInt(p.PieceSize, 10),
+				strconv.FormatInt(p.Bytes, 10),
+				p.PackedAt.Format(time.RFC3339),
+				strconv.Itoa(p.Deals),
+			})
+		}
+	}
+	table.Rows = append(table.Rows, []string{"TOTAL", "", strconv.Itoa(r.Undealt + r.Failed), "", strconv.FormatInt(r.Bytes, 10), "", ""})
+	return table
+}
+
+type pieceOutcome struct {
+	deals int
+	// pending is set if a deal is still in flight or has succeeded.
+	pending bool
+}
+
+// dealOutcomes counts the deals of each piece and whether any of them is still in flight or has succeeded.
+func dealOutcomes(ctx context.Context, db *mongo.Database, pieceCIDs []string) (map[string]pieceOutcome, error) {
+	cursor, err := db.Collection("deals").Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"pieceCid": bson.M{"$in": pieceCIDs}}},
+		bson.M{"$group": bson.M{
+			"_id":   "$pieceCid",
+			"deals": bson.M{"$sum": 1},
+			"pending": bson.M{"$max": bson.M{"$in": bson.A{
+				"$state", bson.A{"proposed", "published", "active", "expired"},
+			}}},
+		}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to aggregate deals")
+	}
+	defer cursor.Close(ctx)
+	var rows []struct {
+		PieceCID string `bson:"_id"`
+		Deals    int    `bson:"deals"`
+		Pending  bool   `bson:"pending"`
+	}
+	err = cursor.All(ctx, &rows)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode deals")
+	}
+	result := make(map[string]pieceOutcome, len(rows))
+	for _, row := range rows {
+		result[row.PieceCID] = pieceOutcome{deals: row.Deals, pending: row.Pending}
+	}
+	return result, nil
+}
+
+// Stranded finds the pieces in cars that never got a deal, or whose deals all failed, grouped by instance and
+// dataset. Deals that are proposed, published, active or expired count as success or as still in flight.
+func Stranded(ctx context.Context, db *mongo.Database, opts StrandedOptions) (*StrandedReport, error) {
+	if opts.MinAgeDays < 0 || opts.MaxAgeDays < 0 {
+		return nil, errors.Wrap(ErrInvalidRequest, "ages must not be negative")
+	}
+	now := time.Now().UTC()
+	createdAt := bson.M{"$lte": now.AddDate(0, 0, -opts.MinAgeDays)}
+	if opts.MaxAgeDays > 0 {
+		createdAt["$gte"] = now.AddDate(0, 0, -opts.MaxAgeDays)
+	}
+	cursor, err := db.Collection("cars").Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"createdAt": createdAt}},
+		bson.M{"$group": bson.M{
+			"_id": bson.M{
+				"pieceCid":    "$pieceCid",
+				"datasetName": "$datasetName",
+				"instanceId":  "$instanceId",
+			},
+			"pieceSize": bson.M{"$max": "$pieceSize"},
+			"bytes":     bson.M{"$sum": "$fileSize"},
+			"packedAt":  bson.M{"$min": "$createdAt"},
+		}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to aggregate cars")
+	}
+	defer cursor.Close(ctx)
+
+	type packedPiece struct {
+		carPiece
+		piece StrandedPiece
+	}
+	report := &StrandedReport{MinAgeDays: opts.MinAgeDays, MaxAgeDays: opts.MaxAgeDays}
+	groups := make(map[[2]string]*StrandedDataset)
+	var batch []packedPiece
+	flush := func() error {
+		pieceCIDs := make([]string, 0, len(batch))
+		for _, p := range batch {
+			pieceCIDs = append(pieceCIDs, p.PieceCID)
+		}
+		outcomes, err := dealOutcomes(ctx, db, pieceCIDs)
+		if err != nil {
+			return err
+		}
+		for _, p := range batch {
+			outcome := outcomes[p.PieceCID]
+			if outcome.pending {
+				continue
+			}
+			key := [2]string{p.InstanceID, p.DatasetName}
+			group, ok := groups[key]
+			if !ok {
+				group = &StrandedDataset{InstanceID: p.InstanceID, DatasetName: p.DatasetName}
+				groups[key] = group
+			}
+			p.piece.Deals = outcome.deals
+			if outcome.deals == 0 {
+				group.Undealt++
+				report.Undealt++
+			} else {
+				group.Failed++
+				report.Failed++
+			}
+			group.Bytes += p.piece.Bytes
+			report.Bytes += p.piece.Bytes
+			group.Pieces = append(group.Pieces, p.piece)
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var row struct {
+			ID struct {
+				PieceCID    string `bson:"pieceCid"`
+				DatasetName string `bson:"datasetName"`
+				InstanceID  string `bson:"instanceId"`
+			} `bson:"_id"`
+			PieceSize int64     `bson:"pieceSize"`
+			Bytes     int64     `bson:"bytes"`
+			PackedAt  time.Time `bson:"packedAt"`
+		}
+		err = cursor.Decode(&row)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode car")
+		}
+		batch = append(batch, packedPiece{
+			carPiece: carPiece(row.ID),
+			piece:    StrandedPiece{PieceCID: row.ID.PieceCID, PieceSize: row.PieceSize, Bytes: row.Bytes, PackedAt: row.PackedAt},
+		})
+		if len(batch) >= pieceBatchSize {
+			err = flush()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to iterate cars")
+	}
+	if len(batch) > 0 {
+		err = flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, group := range groups {
+		sort.Slice(group.Pieces, func(i, j int) bool {
+			return group.Pieces[i].PackedAt.Before(group.Pieces[j].PackedAt)
+		})
+		report.Datasets = append(report.Datasets, *group)
+	}
+	sort.Slice(report.Datasets, func(i, j int) bool {
+		return report.Datasets[i].Bytes > report.Datasets[j].Bytes
+	})
+	return report, nil
+}
@@ -0,0 +1,252 @@
+package retention
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/instance"
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	RunsCollection = "retentionRuns"
+	batchSize      = 1000
+)
+
+// Collections are the collections whose documents keep the IP of their reporter.
+var Collections = []string{"cars", "deals", "v1Events", "quarantine"}
+
+// Policy decides when the IPs of reporters are truncated to a network prefix.
+type Policy struct {
+	// AtIngestion truncates IPs before new documents are saved.
+	AtIngestion bool `json:"atIngestion" bson:"atIngestion"`
+	// AfterDays truncates the IPs of documents older than this many days. Negative values keep IPs forever.
+	AfterDays int `json:"afterDays" bson:"afterDays"`
+	IPv4Bits  int `json:"ipv4Bits" bson:"ipv4Bits"`
+	IPv6Bits  int `json:"ipv6Bits" bson:"ipv6Bits"`
+}
+
+var DefaultPolicy = Policy{AfterDays: -1, IPv4Bits: 24, IPv6Bits: 48}
+
+func intEnv(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(value)
+	return n, errors.Wrapf(err, "invalid %s", name)
+}
+
+// PolicyFromEnv reads the policy from IP_TRUNCATE_AT_INGESTION, IP_RETENTION_DAYS, IPV4_PREFIX_BITS and
+// IPV6_PREFIX_BITS, starting from the default policy.
+func PolicyFromEnv() (Policy, error) {
+	policy := DefaultPolicy
+	var err error
+	if value := os.Getenv("IP_TRUNCATE_AT_INGESTION"); value != "" {
+		policy.AtIngestion, err = strconv.ParseBool(value)
+		if err != nil {
+			return policy, errors.Wrap(err, "invalid IP_TRUNCATE_AT_INGESTION")
+		}
+	}
+	if policy.AfterDays, err = intEnv("IP_RETENTION_DAYS", policy.AfterDays); err != nil {
+		return policy, err
+	}
+	if policy.IPv4Bits, err = intEnv("IPV4_PREFIX_BITS", policy.IPv4Bits); err != nil {
+		return policy, err
+	}
+	if policy.IPv6Bits, err = intEnv("IPV6_PREFIX_BITS", policy.IPv6Bits); err != nil {
+		return policy, err
+	}
+	return policy, policy.Validate()
+}
+
+func (p Policy) Validate() error {
+	if p.IPv4Bits < 0 || p.IPv4Bits > 32 {
+		return errors.Errorf("IPv4 prefix must be between 0 and 32 bits, got %d", p.IPv4Bits)
+	}
+	if p.IPv6Bits < 0 || p.IPv6Bits > 128 {
+		return errors.Errorf("IPv6 prefix must be between 0 and 128 bits, got %d", p.IPv6Bits)
+	}
+	return nil
+}
+
+// Truncate returns the network prefix of the IP with the host bits cleared. Values that are not IPs are dropped.
+func (p Policy) Truncate(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(p.IPv4Bits, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(p.IPv6Bits, 128)).String()
+}
+
+// TruncateReporter truncates the IP of a reporter and marks it as truncated.
+func (p Policy) TruncateReporter(reporter *model.Reporter) {
+	if reporter.IPTruncated {
+		return
+	}
+	reporter.IP = p.Truncate(reporter.IP)
+	reporter.IPTruncated = true
+}
+
+// Run records a run of the policy over the stored documents.
+type Run struct {
+	ID         primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Policy     Policy             `json:"policy" bson:"policy"`
+	Cutoff     time.Time          `json:"cutoff" bson:"cutoff"`
+	StartedAt  time.Time          `json:"startedAt" bson:"startedAt"`
+	FinishedAt time.Time          `json:"finishedAt" bson:"finishedAt"`
+	// Truncated is the number of documents truncated per collection, and of instances for "instances".
+	Truncated map[string]int64 `json:"truncated" bson:"truncated"`
+	Error     string           `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// truncateCollection truncates the IPs of the documents created before the cutoff that have not been truncated yet.
+func truncateCollection(ctx context.Context, db *mongo.Database, collection string, policy Policy, cutoff time.Time) (int64, error) {
+	cursor, err := db.Collection(collection).Find(ctx, bson.M{
+		"createdAt":   bson.M{"$lt": cutoff},
+		"ip":          bson.M{"$nin": bson.A{"", nil}},
+		"ipTruncated": bson.M{"$ne": true},
+	}, options.Find().SetProjection(bson.M{"ip": 1}).SetBatchSize(batchSize))
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to query %s", collection)
+	}
+	defer cursor.Close(ctx)
+	var total int64
+	var writes []mongo.WriteModel
+	flush := func() error {
+		if len(writes) == 0 {
+			return nil
+		}
+		result, err := db.Collection(collection).BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return errors.Wrapf(err, "failed to truncate IPs in %s", collection)
+		}
+		total += result.ModifiedCount
+		writes = writes[:0]
+		return nil
+	}
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID any    `bson:"_id"`
+			IP string `bson:"ip"`
+		}
+		err = cursor.Decode(&doc)
+		if err != nil {
+			return total, errors.Wrapf(err, "failed to decode %s", collection)
+		}
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": doc.ID}).
+			SetUpdate(bson.M{"$set": bson.M{"ip": policy.Truncate(doc.IP), "ipTruncated": true}}))
+		if len(writes) >= batchSize {
+			err = flush()
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return total, errors.Wrapf(err, "failed to iterate %s", collection)
+	}
+	return total, flush()
+}
+
+// truncateInstances truncates the known IPs of every instance. The registry does not record when each IP was
+// seen, so they are truncated whenever the policy is applied rather than once past the retention period.
+func truncateInstances(ctx context.Context, db *mongo.Database, policy Policy) (int64, error) {
+	cursor, err := db.Collection(instance.Collection).Find(ctx, bson.M{"ips.0": bson.M{"$exists": true}},
+		options.Find().SetProjection(bson.M{"ips": 1}))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to query instances")
+	}
+	defer cursor.Close(ctx)
+	var total int64
+	for cursor.Next(ctx) {
+		var doc struct {
+			ID  string   `bson:"_id"`
+			IPs []string `bson:"ips"`
+		}
+		err = cursor.Decode(&doc)
+		if err != nil {
+			return total, errors.Wrap(err, "failed to decode instance")
+		}
+		ips := make([]string, 0, len(doc.IPs))
+		changed := false
+		for _, ip := range doc.IPs {
+			truncated := policy.Truncate(ip)
+			changed = changed || truncated != ip
+			if truncated != "" && !contains(ips, truncated) {
+				ips = append(ips, truncated)
+			}
+		}
+		if !changed {
+			continue
+		}
+		_, err = db.Collection(instance.Collection).UpdateOne(ctx, bson.M{"_id": doc.ID}, bson.M{"$set": bson.M{"ips": ips}})
+		if err != nil {
+			return total, errors.Wrap(err, "failed to truncate instance IPs")
+		}
+		total++
+	}
+	return total, errors.Wrap(cursor.Err(), "failed to iterate instances")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply truncates the IPs of every document older than the retention period of the policy and the IPs of the
+// instance registry, and records the run.
+func Apply(ctx context.Context, db *mongo.Database, policy Policy) (*Run, error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	if policy.AfterDays < 0 {
+		log.Println("IP retention is disabled, nothing to truncate")
+		return nil, nil
+	}
+	run := &Run{
+		Policy:    policy,
+		StartedAt: time.Now().UTC(),
+		Truncated: make(map[string]int64),
+	}
+	run.Cutoff = run.StartedAt.AddDate(0, 0, -policy.AfterDays)
+	var err error
+	for _, collection := range Collections {
+		var n int64
+		n, err = truncateCollection(ctx, db, collection, policy, run.Cutoff)
+		run.Truncated[collection] = n
+		if err != nil {
+			break
+		}
+		log.Printf("truncated %d IPs in %s\n", n, collection)
+	}
+	if err == nil {
+		run.Truncated[instance.Collection], err = truncateInstances(ctx, db, policy)
+	}
+	run.FinishedAt = time.Now().UTC()
+	if err != nil {
+		run.Error = err.Error()
+	}
+	_, recordErr := db.Collection(RunsCollection).InsertOne(ctx, run)
+	if err != nil {
+		return run, err
+	}
+	return run, errors.Wrap(recordErr, "failed to record retention run")
+}
@@ -0,0 +1,267 @@
+package schema
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// IndexSpec declares an index the metrics database is expected to have.
+type IndexSpec struct {
+	Collection string `json:"collection"`
+	Name       string `json:"name"`
+	Keys       bson.D `json:"keys"`
+	Unique     bool   `json:"unique,omitempty"`
+	// Partial restricts the index to the documents matching the filter, so that unique indexes can leave out
+	// documents without the field.
+	Partial bson.M `json:"partial,omitempty"`
+	// ExpireAfterSeconds makes a TTL index on a date field if positive.
+	ExpireAfterSeconds int32 `json:"expireAfterSeconds,omitempty"`
+}
+
+func (s IndexSpec) model() mongo.IndexModel {
+	opts := options.Index().SetName(s.Name)
+	if s.Unique {
+		opts.SetUnique(true)
+	}
+	if s.ExpireAfterSeconds > 0 {
+		opts.SetExpireAfterSeconds(s.ExpireAfterSeconds)
+	}
+	if s.Partial != nil {
+		opts.SetPartialFilterExpression(s.Partial)
+	}
+	return mongo.IndexModel{Keys: s.Keys, Options: opts}
+}
+
+func asc(fields ...string) bson.D {
+	keys := make(bson.D, 0, len(fields))
+	for _, f := range fields {
+		keys = append(keys, bson.E{Key: f, Value: 1})
+	}
+	return keys
+}
+
+func exists(field string) bson.M {
+	return bson.M{field: bson.M{"$exists": true}}
+}
+
+func nonEmpty(field string) bson.M {
+	return bson.M{field: bson.M{"$gt": ""}}
+}
+
+// Indexes are the indexes of the metrics database, besides the default index on _id.
+var Indexes = []IndexSpec{
+	{Collection: "cars", Name: "pieceCid", Keys: asc("pieceCid")},
+	{Collection: "cars", Name: "createdAt", Keys: asc("createdAt")},
+	{Collection: "cars", Name: "instanceId", Keys: asc("instanceId")},
+	{Collection: "cars", Name: "fingerprint", Keys: asc("fingerprint"), Unique: true, Partial: exists("fingerprint")},
+
+	{Collection: "deals", Name: "dealId", Keys: asc("dealId"), Unique: true, Partial: exists("dealId")},
+	{Collection: "deals", Name: "pieceCid_createdAt", Keys: asc("pieceCid", "createdAt")},
+	{Collection: "deals", Name: "state_endEpoch", Keys: asc("state", "endEpoch")},
+	{Collection: "deals", Name: "state_startEpoch", Keys: asc("state", "startEpoch")},
+	{Collection: "deals", Name: "createdAt", Keys: asc("createdAt")},
+	{Collection: "deals", Name: "client", Keys: asc("client")},
+	{Collection: "deals", Name: "provider_createdAt", Keys: asc("provider", "createdAt")},
+	{Collection: "deals", Name: "instanceId", Keys: asc("instanceId")},
+	{Collection: "deals", Name: "fingerprint", Keys: asc("fingerprint"), Unique: true, Partial: exists("fingerprint")},
+
+	{Collection: "clients", Name: "actorId", Keys: asc("actorId"), Unique: true, Partial: nonEmpty("actorId")},
+	{Collection: "clients", Name: "accountKey", Keys: asc("accountKey"), Unique: true, Partial: nonEmpty("accountKey")},
+
+	{Collection: "verifiedClients", Name: "id", Keys: asc("id"), Unique: true},
+	{Collection: "verifiedClientHistory", Name: "clientId_version", Keys: asc("clientId", "version"), Unique: true},
+
+	{Collection: "datasetProgress", Name: "key_at", Keys: asc("key", "at")},
+	{Collection: "instances", Name: "lastSeenAt", Keys: asc("lastSeenAt")},
+	{Collection: "apiKeys", Name: "hash", Keys: asc("hash"), Unique: true},
+	// Buckets unused for a day are dropped, and start full when they are used again.
+	{Collection: "rateLimits", Name: "updatedAt", Keys: asc("updatedAt"), ExpireAfterSeconds: 24 * 60 * 60},
+	{Collection: "quarantine", Name: "batchId", Keys: asc("quarantine.batchId")},
+	{Collection: "v1Events", Name: "fingerprint", Keys: asc("fingerprint"), Unique: true, Partial: exists("fingerprint")},
+}
+
+// EnsureIndexes creates the declared indexes of the given collections, or of every collection if none are given.
+// Creating an index that already exists with the same options does nothing. Each index is created on its own, so
+// that a unique index failing over duplicate documents does not prevent the others, and every failure is returned.
+func EnsureIndexes(ctx context.Context, db *mongo.Database, collections ...string) error {
+	var ensured int
+	var failures []string
+	for _, spec := range Indexes {
+		if len(collections) > 0 && !contains(collections, spec.Collection) {
+			continue
+		}
+		_, err := db.Collection(spec.Collection).Indexes().CreateOne(ctx, spec.model())
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s.%s: %s", spec.Collection, spec.Name, err))
+			continue
+		}
+		ensured++
+	}
+	log.Printf("ensured %d indexes\n", ensured)
+	if len(failures) > 0 {
+		return errors.Errorf("failed to create %d indexes: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ExistingIndex is an index found in the database.
+type ExistingIndex struct {
+	Collection string `json:"collection"`
+	Name       string `json:"name"`
+	Keys       bson.D `json:"keys"`
+	Unique     bool   `json:"unique,omitempty"`
+	Partial    bson.M `json:"partial,omitempty"`
+	// ExpireAfterSeconds is set on TTL indexes.
+	ExpireAfterSeconds int32 `json:"expireAfterSeconds,omitempty"`
+}
+
+type IndexDrift struct {
+	// Missing are declared indexes that do not exist.
+	Missing []IndexSpec `json:"missing"`
+	// Extra are indexes that are not declared.
+	Extra []ExistingIndex `json:"extra"`
+	// Changed are declared indexes that exist with different keys or options.
+	Changed []ExistingIndex `json:"changed"`
+}
+
+func (d IndexDrift) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Changed) == 0
+}
+
+// namespaceNotFound is the error code of listing the indexes of a collection that does not exist.
+const namespaceNotFound = 26
+
+func listIndexes(ctx context.Context, db *mongo.Database, collection string) ([]ExistingIndex, error) {
+	cursor, err := db.Collection(collection).Indexes().List(ctx)
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && commandErr.Code == namespaceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list indexes of %s", collection)
+	}
+	defer cursor.Close(ctx)
+	var rows []struct {
+		Name    string `bson:"name"`
+		Keys    bson.D `bson:"key"`
+		Unique  bool   `bson:"unique"`
+		Partial bson.M `bson:"partialFilterExpression"`
+		Expire  int64  `bson:"expireAfterSeconds"`
+	}
+	err = cursor.All(ctx, &rows)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode indexes of %s", collection)
+	}
+	indexes := make([]ExistingIndex, 0, len(rows))
+	for _, row := range rows {
+		indexes = append(indexes, ExistingIndex{
+			Collection:         collection,
+			Name:               row.Name,
+			Keys:               row.Keys,
+			Unique:             row.Unique,
+			Partial:            row.Partial,
+			ExpireAfterSeconds: int32(row.Expire),
+		})
+	}
+	return indexes, nil
+}
+
+// sameKeys compares index keys regardless of the numeric type of their direction.
+func sameKeys(a, b bson.D) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key {
+			return false
+		}
+		if toInt(a[i].Value) != toInt(b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+func toInt(v any) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+// samePartial compares partial filters through their extended JSON, since decoded values differ in type.
+func samePartial(a, b bson.M) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	ja, errA := bson.MarshalExtJSON(a, false, false)
+	jb, errB := bson.MarshalExtJSON(b, false, false)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+// Drift compares the indexes of every collection with declared indexes against the declaration. An index that failed
+// to be created, such as a unique index over duplicate documents, does not exist and is reported as missing.
+func Drift(ctx context.Context, db *mongo.Database) (*IndexDrift, error) {
+	drift := &IndexDrift{}
+	var collections []string
+	specs := make(map[string]map[string]IndexSpec)
+	for _, spec := range Indexes {
+		if _, ok := specs[spec.Collection]; !ok {
+			specs[spec.Collection] = make(map[string]IndexSpec)
+			collections = append(collections, spec.Collection)
+		}
+		specs[spec.Collection][spec.Name] = spec
+	}
+	for _, collection := range collections {
+		existing, err := listIndexes(ctx, db, collection)
+		if err != nil {
+			return nil, err
+		}
+		found := make(map[string]bool)
+		for _, index := range existing {
+			if index.Name == "_id_" {
+				continue
+			}
+			spec, ok := specs[collection][index.Name]
+			if !ok {
+				drift.Extra = append(drift.Extra, index)
+				continue
+			}
+			found[index.Name] = true
+			if !sameKeys(spec.Keys, index.Keys) || spec.Unique != index.Unique || !samePartial(spec.Partial, index.Partial) ||
+				spec.ExpireAfterSeconds != index.ExpireAfterSeconds {
+				drift.Changed = append(drift.Changed, index)
+			}
+		}
+		for _, spec := range Indexes {
+			if spec.Collection == collection && !found[spec.Name] {
+				drift.Missing = append(drift.Missing, spec)
+			}
+		}
+	}
+	return drift, nil
+}
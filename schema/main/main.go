@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/schema"
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// withDatabase connects to the metrics database for the duration of a command.
+func withDatabase(c *cli.Context, f func(db *mongo.Database) error) error {
+	mg, err := mongo.Connect(c.Context, options.Client().ApplyURI(c.String("mongodb-uri")))
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to mongo")
+	}
+	defer func() {
+		_ = mg.Disconnect(context.Background())
+	}()
+	return f(mg.Database("singularity"))
+}
+
+func withMigrator(c *cli.Context, f func(m *schema.Migrator) error) error {
+	return withDatabase(c, func(db *mongo.Database) error {
+		m, err := schema.NewMigrator(db, schema.Migrations)
+		if err != nil {
+			return err
+		}
+		return f(m)
+	})
+}
+
+func status(c *cli.Context) error {
+	return withMigrator(c, func(m *schema.Migrator) error {
+		statuses, err := m.Status(c.Context)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tAPPLIED AT\tDESCRIPTION")
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.AppliedAt != nil {
+				appliedAt = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, appliedAt, s.Description)
+		}
+		return errors.Wrap(tw.Flush(), "failed to write status")
+	})
+}
+
+func drift(c *cli.Context) error {
+	return withDatabase(c, func(db *mongo.Database) error {
+		drift, err := schema.Drift(c.Context, db)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "DRIFT\tCOLLECTION\tINDEX\tKEYS\tUNIQUE")
+		for _, spec := range drift.Missing {
+			fmt.Fprintf(tw, "missing\t%s\t%s\t%v\t%t\n", spec.Collection, spec.Name, spec.Keys, spec.Unique)
+		}
+		for _, index := range drift.Changed {
+			fmt.Fprintf(tw, "changed\t%s\t%s\t%v\t%t\n", index.Collection, index.Name, index.Keys, index.Unique)
+		}
+		for _, index := range drift.Extra {
+			fmt.Fprintf(tw, "extra\t%s\t%s\t%v\t%t\n", index.Collection, index.Name, index.Keys, index.Unique)
+		}
+		err = tw.Flush()
+		if err != nil {
+			return errors.Wrap(err, "failed to write drift")
+		}
+		if !drift.Empty() {
+			return cli.Exit("indexes do not match the declared indexes", 1)
+		}
+		return nil
+	})
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app := &cli.App{
+		Name:  "schema",
+		Usage: "Apply and revert the versioned migrations of the metrics database",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "mongodb-uri",
+				Usage:   "MongoDB connection string",
+				EnvVars: []string{"MONGODB_URI"},
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:   "status",
+				Usage:  "List the migrations and when they were applied",
+				Action: status,
+			},
+			{
+				Name:  "up",
+				Usage: "Apply every pending migration",
+				Action: func(c *cli.Context) error {
+					return withMigrator(c, func(m *schema.Migrator) error {
+						return m.Up(c.Context)
+					})
+				},
+			},
+			{
+				Name:  "down",
+				Usage: "Revert the last applied migration",
+				Action: func(c *cli.Context) error {
+					return withMigrator(c, func(m *schema.Migrator) error {
+						return m.Down(c.Context)
+					})
+				},
+			},
+			{
+				Name:      "to",
+				Usage:     "Apply or revert migrations until the database is at the version",
+				ArgsUsage: "<version>",
+				Action: func(c *cli.Context) error {
+					version, err := strconv.Atoi(c.Args().First())
+					if err != nil {
+						return errors.Wrap(err, "invalid version")
+					}
+					return withMigrator(c, func(m *schema.Migrator) error {
+						return m.To(c.Context, version)
+					})
+				},
+			},
+			{
+				Name:   "indexes",
+				Usage:  "List the indexes that are missing, changed or not declared",
+				Action: drift,
+				Subcommands: []*cli.Command{
+					{
+						Name:  "apply",
+						Usage: "Create the declared indexes that are missing",
+						Action: func(c *cli.Context) error {
+							return withDatabase(c, func(db *mongo.Database) error {
+								return schema.EnsureIndexes(c.Context, db)
+							})
+						},
+					},
+				},
+			},
+		},
+	}
+	if err := app.RunContext(ctx, os.Args); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,35 @@
+package schema
+
+import (
+	"context"
+
+	"github.com/data-preservation-programs/singularity-metrics/dataset"
+	"github.com/data-preservation-programs/singularity-metrics/instance"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Migrations are the migrations of the metrics database. Append new migrations with the next version,
+// and never change one that has been released.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Backfill datasets and the instance registry from existing cars and deals",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := dataset.Refresh(ctx, db)
+			if err != nil {
+				return err
+			}
+			_, err = instance.Rebuild(ctx, db)
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			for _, collection := range []string{dataset.Collection, dataset.ProgressCollection, instance.Collection} {
+				err := db.Collection(collection).Drop(ctx)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
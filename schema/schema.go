@@ -0,0 +1,189 @@
+package schema
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const Collection = "schemaMigrations"
+
+// Migration changes the documents or indexes of the database from the previous version to Version, and back.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+	Down        func(ctx context.Context, db *mongo.Database) error
+}
+
+// Record is saved for each applied migration.
+type Record struct {
+	Version     int       `json:"version" bson:"_id"`
+	Description string    `json:"description" bson:"description"`
+	AppliedAt   time.Time `json:"appliedAt" bson:"appliedAt"`
+}
+
+type Status struct {
+	Version     int        `json:"version"`
+	Description string     `json:"description"`
+	AppliedAt   *time.Time `json:"appliedAt,omitempty"`
+}
+
+// Migrator applies a list of migrations ordered by version.
+type Migrator struct {
+	db         *mongo.Database
+	migrations []Migration
+}
+
+func NewMigrator(db *mongo.Database, migrations []Migration) (*Migrator, error) {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	for i, m := range sorted {
+		if m.Version < 1 {
+			return nil, errors.Errorf("migration %q has version %d, versions start at 1", m.Description, m.Version)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, errors.Errorf("duplicate migration version %d", m.Version)
+		}
+		if m.Up == nil || m.Down == nil {
+			return nil, errors.Errorf("migration %d must have both up and down steps", m.Version)
+		}
+	}
+	return &Migrator{db: db, migrations: sorted}, nil
+}
+
+// Latest returns the version of the last migration, or 0 if there are none.
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]Record, error) {
+	cursor, err := m.db.Collection(Collection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get applied migrations")
+	}
+	defer cursor.Close(ctx)
+	var records []Record
+	err = cursor.All(ctx, &records)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode applied migrations")
+	}
+	result := make(map[int]Record, len(records))
+	for _, r := range records {
+		result[r.Version] = r
+	}
+	return result, nil
+}
+
+// Status lists every migration and when it was applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := Status{Version: migration.Version, Description: migration.Description}
+		if r, ok := applied[migration.Version]; ok {
+			appliedAt := r.AppliedAt
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Current returns the highest applied version, or 0 if no migration has been applied.
+func (m *Migrator) Current(ctx context.Context) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var current int
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+	return current, nil
+}
+
+// Up applies every pending migration.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.To(ctx, m.Latest())
+}
+
+// Down reverts the last applied migration.
+func (m *Migrator) Down(ctx context.Context) error {
+	current, err := m.Current(ctx)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		log.Println("no migration to revert")
+		return nil
+	}
+	previous := 0
+	for _, migration := range m.migrations {
+		if migration.Version < current {
+			previous = migration.Version
+		}
+	}
+	return m.To(ctx, previous)
+}
+
+// To applies the pending migrations up to and including the version, and reverts the applied migrations above it,
+// latest first. Each migration is recorded as soon as it succeeds, so a failed run can be resumed.
+func (m *Migrator) To(ctx context.Context, version int) error {
+	if version < 0 || version > m.Latest() {
+		return errors.Errorf("unknown version %d, latest is %d", version, m.Latest())
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if _, ok := applied[migration.Version]; !ok || migration.Version <= version {
+			continue
+		}
+		log.Printf("reverting migration %d: %s\n", migration.Version, migration.Description)
+		err = migration.Down(ctx, m.db)
+		if err != nil {
+			return errors.Wrapf(err, "failed to revert migration %d", migration.Version)
+		}
+		_, err = m.db.Collection(Collection).DeleteOne(ctx, bson.M{"_id": migration.Version})
+		if err != nil {
+			return errors.Wrapf(err, "failed to unrecord migration %d", migration.Version)
+		}
+	}
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok || migration.Version > version {
+			continue
+		}
+		log.Printf("applying migration %d: %s\n", migration.Version, migration.Description)
+		err = migration.Up(ctx, m.db)
+		if err != nil {
+			return errors.Wrapf(err, "failed to apply migration %d", migration.Version)
+		}
+		_, err = m.db.Collection(Collection).ReplaceOne(ctx, bson.M{"_id": migration.Version}, Record{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedAt:   time.Now().UTC(),
+		}, options.Replace().SetUpsert(true))
+		if err != nil {
+			return errors.Wrapf(err, "failed to record migration %d", migration.Version)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func noop(context.Context, *mongo.Database) error {
+	return nil
+}
+
+func TestNewMigratorValidatesMigrations(t *testing.T) {
+	tests := []struct {
+		name       string
+		migrations []Migration
+	}{
+		{"version zero", []Migration{{Version: 0, Up: noop, Down: noop}}},
+		{"duplicate version", []Migration{{Version: 1, Up: noop, Down: noop}, {Version: 1, Up: noop, Down: noop}}},
+		{"missing down", []Migration{{Version: 1, Up: noop}}},
+		{"missing up", []Migration{{Version: 1, Down: noop}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewMigrator(nil, test.migrations); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestNewMigratorSortsMigrations(t *testing.T) {
+	m, err := NewMigrator(nil, []Migration{{Version: 3, Up: noop, Down: noop}, {Version: 1, Up: noop, Down: noop}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Latest() != 3 || m.migrations[0].Version != 1 {
+		t.Fatalf("migrations are not sorted by version: %+v", m.migrations)
+	}
+}
+
+// testDatabase returns a new database on the server at MONGODB_TEST_URI, dropped when the test ends.
+func testDatabase(t *testing.T) *mongo.Database {
+	uri := os.Getenv("MONGODB_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGODB_TEST_URI is not set")
+	}
+	ctx := context.Background()
+	mg, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := mg.Database(fmt.Sprintf("schema_test_%d", time.Now().UnixNano()))
+	t.Cleanup(func() {
+		_ = db.Drop(context.Background())
+		_ = mg.Disconnect(context.Background())
+	})
+	return db
+}
+
+// markerMigration creates a collection named after its version on the way up and drops it on the way down.
+func markerMigration(version int) Migration {
+	name := fmt.Sprintf("marker%d", version)
+	return Migration{
+		Version:     version,
+		Description: name,
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			_, err := db.Collection(name).InsertOne(ctx, bson.M{"version": version})
+			return err
+		},
+		Down: func(ctx context.Context, db *mongo.Database) error {
+			return db.Collection(name).Drop(ctx)
+		},
+	}
+}
+
+func checkVersion(t *testing.T, db *mongo.Database, m *Migrator, expected int) {
+	t.Helper()
+	ctx := context.Background()
+	current, err := m.Current(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != expected {
+		t.Fatalf("current version is %d, expected %d", current, expected)
+	}
+	for _, migration := range m.migrations {
+		count, err := db.Collection(migration.Description).CountDocuments(ctx, bson.M{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applied := migration.Version <= expected; applied != (count == 1) {
+			t.Fatalf("migration %d: applied %t, found %d documents", migration.Version, applied, count)
+		}
+	}
+}
+
+func TestMigratorRoundTrip(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	m, err := NewMigrator(db, []Migration{markerMigration(1), markerMigration(2), markerMigration(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, m, 0)
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, m, 3)
+	// Applying again is a no-op, the markers would otherwise be inserted twice.
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, m, 3)
+
+	if err := m.Down(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, m, 2)
+
+	if err := m.To(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, m, 0)
+	if err := m.Down(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, m, 0)
+
+	if err := m.To(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, m, 1)
+	if err := m.To(ctx, 4); err == nil {
+		t.Fatal("expected an error for an unknown version")
+	}
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if (status.AppliedAt != nil) != (status.Version == 1) {
+			t.Fatalf("unexpected status %+v", status)
+		}
+	}
+}
+
+func TestMigratorResumesAfterFailure(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	failing := markerMigration(2)
+	fail := true
+	up := failing.Up
+	failing.Up = func(ctx context.Context, db *mongo.Database) error {
+		if fail {
+			return errors.New("failed on purpose")
+		}
+		return up(ctx, db)
+	}
+	m, err := NewMigrator(db, []Migration{markerMigration(1), failing, markerMigration(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(ctx); err == nil {
+		t.Fatal("expected the second migration to fail")
+	}
+	checkVersion(t, db, m, 1)
+	fail = false
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, db, m, 3)
+}
+
+func TestMigrationsRoundTrip(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	m, err := NewMigrator(db, Migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.To(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	current, err := m.Current(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != m.Latest() {
+		t.Fatalf("current version is %d, expected %d", current, m.Latest())
+	}
+}
+
+func TestEnsureIndexesCreatesTheOthersWhenOneFails(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+	_, err := db.Collection("deals").InsertMany(ctx, []any{
+		bson.M{"dealId": 1, "pieceCid": "a"},
+		bson.M{"dealId": 1, "pieceCid": "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = EnsureIndexes(ctx, db, "deals")
+	if err == nil || !strings.Contains(err.Error(), "deals.dealId") {
+		t.Fatalf("expected the dealId index to fail, got %v", err)
+	}
+	drift, err := Drift(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var missing []string
+	for _, spec := range drift.Missing {
+		if spec.Collection == "deals" {
+			missing = append(missing, spec.Name)
+		}
+	}
+	if len(missing) != 1 || missing[0] != "dealId" {
+		t.Fatalf("missing deals indexes are %q, expected only dealId", missing)
+	}
+}
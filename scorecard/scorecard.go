@@ -0,0 +1,132 @@
+package scorecard
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const Collection = "providerScorecards"
+
+// Windows are the rolling windows, in days, a scorecard is computed for.
+var Windows = []int{7, 30, 90}
+
+func rate(part int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
+
+// countIn sums 1 for every deal whose state is one of the given states.
+func countIn(states ...string) bson.M {
+	return bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$in": bson.A{"$state", states}}, 1, 0}}}
+}
+
+// compute aggregates the deals proposed through Singularity since the given time by provider.
+// Deals found on chain without a proposal are left out since they were accepted by definition. The average price
+// only covers v1 proposals, the only ones that record a price, and is nil for providers without any.
+func compute(ctx context.Context, db *mongo.Database, since time.Time) ([]model.ProviderScorecard, error) {
+	cursor, err := db.Collection("deals").Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"instanceId": bson.M{"$ne": "external"}, "createdAt": bson.M{"$gte": since}}},
+		bson.M{"$group": bson.M{
+			"_id":             "$provider",
+			"proposals":       bson.M{"$sum": 1},
+			"accepted":        countIn("published", "active", "expired", "slashed"),
+			"activated":       countIn("active", "expired", "slashed"),
+			"proposalExpired": countIn("proposal_expired"),
+			"slashed":         countIn("slashed"),
+			"averagePrice":    bson.M{"$avg": bson.M{"$cond": bson.A{"$isV1", "$price", nil}}},
+			"verified":        bson.M{"$sum": bson.M{"$cond": bson.A{"$verified", 1, 0}}},
+		}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to aggregate deals")
+	}
+	defer cursor.Close(ctx)
+	var rows []struct {
+		Provider        string   `bson:"_id"`
+		Proposals       int64    `bson:"proposals"`
+		Accepted        int64    `bson:"accepted"`
+		Activated       int64    `bson:"activated"`
+		ProposalExpired int64    `bson:"proposalExpired"`
+		Slashed         int64    `bson:"slashed"`
+		AveragePrice    *float64 `bson:"averagePrice"`
+		Verified        int64    `bson:"verified"`
+	}
+	err = cursor.All(ctx, &rows)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode deal counts")
+	}
+	scorecards := make([]model.ProviderScorecard, 0, len(rows))
+	for _, row := range rows {
+		scorecards = append(scorecards, model.ProviderScorecard{
+			Key:                 model.ScorecardKey{Provider: row.Provider},
+			Proposals:           row.Proposals,
+			Accepted:            row.Accepted,
+			Activated:           row.Activated,
+			ProposalExpired:     row.ProposalExpired,
+			Slashed:             row.Slashed,
+			AcceptanceRate:      rate(row.Accepted, row.Proposals),
+			ActivationRate:      rate(row.Activated, row.Proposals),
+			ProposalExpiredRate: rate(row.ProposalExpired, row.Proposals),
+			SlashingRate:        rate(row.Slashed, row.Activated),
+			AveragePrice:        row.AveragePrice,
+			VerifiedRatio:       rate(row.Verified, row.Proposals),
+		})
+	}
+	return scorecards, nil
+}
+
+// Refresh recomputes the scorecard of every provider for every window, and removes the scorecards of
+// providers that no longer have proposals within a window.
+func Refresh(ctx context.Context, db *mongo.Database) (int, error) {
+	now := time.Now().UTC()
+	var total int
+	for _, days := range Windows {
+		scorecards, err := compute(ctx, db, now.AddDate(0, 0, -days))
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to compute %d day scorecards", days)
+		}
+		for _, s := range scorecards {
+			s.Key.WindowDays = days
+			s.ComputedAt = now
+			_, err = db.Collection(Collection).ReplaceOne(ctx, bson.M{"_id": s.Key}, s, options.Replace().SetUpsert(true))
+			if err != nil {
+				return 0, errors.Wrap(err, "failed to save scorecard")
+			}
+		}
+		total += len(scorecards)
+	}
+	_, err := db.Collection(Collection).DeleteMany(ctx, bson.M{"computedAt": bson.M{"$lt": now}})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to delete stale scorecards")
+	}
+	log.Printf("refreshed %d provider scorecards\n", total)
+	return total, nil
+}
+
+// List returns the materialized scorecards for a window, optionally of a single provider, busiest provider first.
+func List(ctx context.Context, db *mongo.Database, windowDays int, provider string) ([]model.ProviderScorecard, error) {
+	filter := bson.M{"_id.windowDays": windowDays}
+	if provider != "" {
+		filter["_id.provider"] = provider
+	}
+	cursor, err := db.Collection(Collection).Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "proposals", Value: -1}}))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get scorecards")
+	}
+	defer cursor.Close(ctx)
+	var scorecards []model.ProviderScorecard
+	err = cursor.All(ctx, &scorecards)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode scorecards")
+	}
+	return scorecards, nil
+}
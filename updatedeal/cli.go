@@ -0,0 +1,108 @@
+package main
+
+import (
+	"runtime"
+
+	"github.com/urfave/cli/v2"
+)
+
+// commonFlags returns the flags shared by the app and every subcommand. Each command gets its own instances, so that
+// the flags can be given before or after the subcommand name. Only the flags of the app read the environment, so that
+// a flag given to the app on the command line is not hidden by an environment variable read again by the subcommand.
+func commonFlags(fromEnv bool) []cli.Flag {
+	env := func(name string) []string {
+		if !fromEnv {
+			return nil
+		}
+		return []string{name}
+	}
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:    "mongodb-uri",
+			Usage:   "MongoDB connection string",
+			EnvVars: env("MONGODB_URI"),
+		},
+		&cli.IntFlag{
+			Name:    "concurrency",
+			Usage:   "Number of workers used to prepare market deals and resolve their clients",
+			EnvVars: env("DEAL_SYNC_CONCURRENCY"),
+			Value:   runtime.NumCPU(),
+		},
+		&cli.BoolFlag{
+			Name:    "dry-run",
+			Usage:   "Run the matching logic without writing and print a report of the planned changes",
+			EnvVars: env("DRY_RUN"),
+		},
+		&cli.StringFlag{
+			Name:    "report-format",
+			Usage:   "Format of the dry run report, text or json",
+			EnvVars: env("REPORT_FORMAT"),
+			Value:   "text",
+		},
+	}
+}
+
+// flagContext returns the innermost context the flag was set in, or the context of the app, which holds the value from
+// the environment or the default. The flag of a subcommand would otherwise hide the value given to the app.
+func flagContext(c *cli.Context, name string) *cli.Context {
+	app := c
+	for _, ctx := range c.Lineage() {
+		if ctx.Command == nil {
+			continue
+		}
+		for _, set := range ctx.LocalFlagNames() {
+			if set == name {
+				return ctx
+			}
+		}
+		app = ctx
+	}
+	return app
+}
+
+func optionsFromContext(c *cli.Context) runOptions {
+	return runOptions{
+		MongoURI:     flagContext(c, "mongodb-uri").String("mongodb-uri"),
+		Concurrency:  flagContext(c, "concurrency").Int("concurrency"),
+		DryRun:       flagContext(c, "dry-run").Bool("dry-run"),
+		ReportFormat: flagContext(c, "report-format").String("report-format"),
+	}
+}
+
+func stageCommand(s stage) *cli.Command {
+	return &cli.Command{
+		Name:  s.Name,
+		Usage: s.Usage,
+		Flags: commonFlags(false),
+		Action: func(c *cli.Context) error {
+			return runStages(c.Context, optionsFromContext(c), s)
+		},
+	}
+}
+
+func runAll(c *cli.Context) error {
+	return runStages(c.Context, optionsFromContext(c), stages...)
+}
+
+func newApp() *cli.App {
+	commands := []*cli.Command{
+		{
+			Name:   "all",
+			Usage:  "Run every stage in order",
+			Flags:  commonFlags(false),
+			Action: runAll,
+		},
+	}
+	for _, s := range stages {
+		commands = append(commands, stageCommand(s))
+	}
+	commands = append(commands, daemonCommand())
+	return &cli.App{
+		Name:  "updatedeal",
+		Usage: "Sync verified clients, client mappings and deal states into the metrics database",
+		// Running without a subcommand runs every stage, as the container does by default.
+		Flags:    commonFlags(true),
+		Action:   runAll,
+		Commands: commands,
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestCommonFlagsBeforeOrAfterSubcommand(t *testing.T) {
+	tests := []struct {
+		name         string
+		reportFormat string
+		args         []string
+		expected     runOptions
+	}{
+		{"defaults", "", []string{"stage"}, runOptions{Concurrency: 4, ReportFormat: "text"}},
+		{"before the subcommand", "", []string{"--dry-run", "--concurrency", "2", "stage"},
+			runOptions{Concurrency: 2, DryRun: true, ReportFormat: "text"}},
+		{"after the subcommand", "", []string{"stage", "--dry-run", "--report-format", "json"},
+			runOptions{Concurrency: 4, DryRun: true, ReportFormat: "json"}},
+		{"environment", "json", []string{"stage"}, runOptions{Concurrency: 4, ReportFormat: "json"}},
+		{"subcommand wins", "", []string{"--mongodb-uri", "mongodb://app", "stage", "--mongodb-uri", "mongodb://stage"},
+			runOptions{MongoURI: "mongodb://stage", Concurrency: 4, ReportFormat: "text"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("DEAL_SYNC_CONCURRENCY", "4")
+			t.Setenv("REPORT_FORMAT", test.reportFormat)
+			if test.reportFormat == "" {
+				// An empty variable still overrides the default.
+				os.Unsetenv("REPORT_FORMAT")
+			}
+			var opts runOptions
+			app := &cli.App{
+				Flags: commonFlags(true),
+				Commands: []*cli.Command{{
+					Name:  "stage",
+					Flags: commonFlags(false),
+					Action: func(c *cli.Context) error {
+						opts = optionsFromContext(c)
+						return nil
+					},
+				}},
+			}
+			if err := app.Run(append([]string{"updatedeal"}, test.args...)); err != nil {
+				t.Fatal(err)
+			}
+			if opts != test.expected {
+				t.Fatalf("options are %+v, expected %+v", opts, test.expected)
+			}
+		})
+	}
+}
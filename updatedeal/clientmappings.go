@@ -11,12 +11,15 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/sync/singleflight"
 )
 
 type ClientMappingResolver struct {
 	mu                sync.Mutex
+	group             singleflight.Group
 	lotusClient       jsonrpc.RPCClient
 	mg                *mongo.Client
+	dryRun            bool
 	actorToAccountKey map[string]model.ClientMapping
 	accountKeyToActor map[string]model.ClientMapping
 	unresolvable      map[string]struct{}
@@ -25,61 +28,110 @@ type ClientMappingResolver struct {
 var errNotFound = errors.New("not found")
 
 func (r *ClientMappingResolver) Get(ctx context.Context, id string) (model.ClientMapping, error) {
+	client, ok, err := r.cached(id)
+	if ok || err != nil {
+		return client, err
+	}
+	// Resolve outside the lock so that different clients can be looked up concurrently,
+	// while concurrent lookups of the same client share a single RPC call and insert.
+	result, err, _ := r.group.Do(id, func() (any, error) {
+		client, ok, err := r.cached(id)
+		if ok || err != nil {
+			return client, err
+		}
+		return r.resolve(ctx, id)
+	})
+	if err != nil {
+		return model.ClientMapping{}, err
+	}
+	return result.(model.ClientMapping), nil
+}
+
+func (r *ClientMappingResolver) cached(id string) (model.ClientMapping, bool, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	if _, ok := r.unresolvable[id]; ok {
-		return model.ClientMapping{}, errNotFound
+		return model.ClientMapping{}, false, errNotFound
 	}
 	if strings.HasPrefix(id, "f0") {
 		client, ok := r.actorToAccountKey[id]
-		if ok {
-			return client, nil
-		}
+		return client, ok, nil
+	}
+	client, ok := r.accountKeyToActor[id]
+	return client, ok, nil
+}
+
+func (r *ClientMappingResolver) markUnresolvable(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unresolvable[id] = struct{}{}
+}
+
+func (r *ClientMappingResolver) store(client model.ClientMapping) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.accountKeyToActor[client.AccountKey] = client
+	r.actorToAccountKey[client.ActorID] = client
+}
+
+func (r *ClientMappingResolver) resolve(ctx context.Context, id string) (model.ClientMapping, error) {
+	if strings.HasPrefix(id, "f0") {
 		key, err := r.getAccountKey(ctx, id)
 		if err != nil {
 			return model.ClientMapping{}, errors.Wrap(err, "failed to get account key")
 		}
-		client = model.ClientMapping{
+		client := model.ClientMapping{
 			ActorID:    id,
 			AccountKey: key,
 		}
-		result, err := r.mg.Database("singularity").Collection("clients").InsertOne(ctx, client)
-		if err != nil {
-			return model.ClientMapping{}, errors.Wrap(err, "failed to insert client mapping")
+		if r.dryRun {
+			r.store(client)
+			return client, nil
 		}
-		client.ID = result.InsertedID.(primitive.ObjectID)
-		r.accountKeyToActor[key] = client
-		r.actorToAccountKey[id] = client
-		return client, nil
+		return r.insert(ctx, client)
 	}
 
-	client, ok := r.accountKeyToActor[id]
-	if ok {
-		return client, nil
-	}
 	actor, err := r.getActorID(ctx, id)
 	if err != nil {
 		if strings.Contains(err.Error(), "not found") {
-			r.unresolvable[id] = struct{}{}
+			r.markUnresolvable(id)
 			return model.ClientMapping{}, errNotFound
 		}
 		return model.ClientMapping{}, errors.Wrap(err, "failed to get actor id")
 	}
-	client = model.ClientMapping{
+	client := model.ClientMapping{
 		ActorID:    actor,
 		AccountKey: id,
 	}
-	result, err := r.mg.Database("singularity").Collection("clients").InsertOne(ctx, client)
-	if err != nil {
-		if strings.Contains(err.Error(), "not found") {
-			r.unresolvable[id] = struct{}{}
-			return model.ClientMapping{}, errNotFound
+	if r.dryRun {
+		r.store(client)
+		return client, nil
+	}
+	return r.insert(ctx, client)
+}
+
+// insert saves a newly resolved mapping. If another process saved the same mapping first, the unique indexes
+// on actorId and accountKey reject the insert and the saved mapping is used instead.
+func (r *ClientMappingResolver) insert(ctx context.Context, client model.ClientMapping) (model.ClientMapping, error) {
+	collection := r.mg.Database("singularity").Collection("clients")
+	result, err := collection.InsertOne(ctx, client)
+	if mongo.IsDuplicateKeyError(err) {
+		var existing model.ClientMapping
+		err = collection.FindOne(ctx, bson.M{"$or": bson.A{
+			bson.M{"actorId": client.ActorID},
+			bson.M{"accountKey": client.AccountKey},
+		}}).Decode(&existing)
+		if err != nil {
+			return model.ClientMapping{}, errors.Wrap(err, "failed to get existing client mapping")
 		}
+		r.store(existing)
+		return existing, nil
+	}
+	if err != nil {
 		return model.ClientMapping{}, errors.Wrap(err, "failed to insert client mapping")
 	}
 	client.ID = result.InsertedID.(primitive.ObjectID)
-	r.accountKeyToActor[id] = client
-	r.actorToAccountKey[actor] = client
+	r.store(client)
 	return client, nil
 }
 
@@ -101,7 +153,8 @@ func (r *ClientMappingResolver) getAccountKey(ctx context.Context, short string)
 	return out, nil
 }
 
-func NewClientMappingResolver(ctx context.Context, mg *mongo.Client) (*ClientMappingResolver, error) {
+// NewClientMappingResolver loads the known client mappings. In dry run mode newly resolved mappings are only cached in memory.
+func NewClientMappingResolver(ctx context.Context, mg *mongo.Client, dryRun bool) (*ClientMappingResolver, error) {
 	result, err := mg.Database("singularity").Collection("clients").Find(ctx, bson.M{})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get client mappings")
@@ -121,6 +174,7 @@ func NewClientMappingResolver(ctx context.Context, mg *mongo.Client) (*ClientMap
 	return &ClientMappingResolver{
 		lotusClient:       jsonrpc.NewClientWithOpts("https://api.node.glif.io/", &jsonrpc.RPCClientOpts{}),
 		mg:                mg,
+		dryRun:            dryRun,
 		actorToAccountKey: actorToAccountKey,
 		accountKeyToActor: accountKeyToActor,
 		unresolvable:      make(map[string]struct{}),
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const stageLeasesCollection = "stageLeases"
+
+// stageLease is both the lock that makes sure only one replica runs a stage at a time and the
+// record of when the stage last ran, which all replicas use to decide when it is next due.
+type stageLease struct {
+	Stage          string    `bson:"_id" json:"stage"`
+	Owner          string    `bson:"owner" json:"owner,omitempty"`
+	ExpiresAt      time.Time `bson:"expiresAt" json:"expiresAt"`
+	LastStartedAt  time.Time `bson:"lastStartedAt,omitempty" json:"lastStartedAt"`
+	LastFinishedAt time.Time `bson:"lastFinishedAt,omitempty" json:"lastFinishedAt"`
+	LastSuccessAt  time.Time `bson:"lastSuccessAt,omitempty" json:"lastSuccessAt"`
+	LastError      string    `bson:"lastError,omitempty" json:"lastError,omitempty"`
+}
+
+type stageStatus struct {
+	stageLease
+	Interval string    `json:"interval"`
+	NextRun  time.Time `json:"nextRun"`
+	Running  bool      `json:"running"`
+}
+
+type daemon struct {
+	runner    *runner
+	owner     string
+	intervals map[string]time.Duration
+	leaseTTL  time.Duration
+}
+
+func (d *daemon) leases() *mongo.Collection {
+	return d.runner.mg.Database("singularity").Collection(stageLeasesCollection)
+}
+
+// acquire takes the lease of a stage if the stage is due and no other replica holds an unexpired lease.
+func (d *daemon) acquire(ctx context.Context, name string) (bool, error) {
+	now := time.Now()
+	_, err := d.leases().UpdateOne(ctx, bson.M{
+		"_id": name,
+		"$and": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"expiresAt": bson.M{"$lte": now}},
+				bson.M{"owner": d.owner},
+			}},
+			bson.M{"$or": bson.A{
+				bson.M{"lastFinishedAt": bson.M{"$exists": false}},
+				bson.M{"lastFinishedAt": bson.M{"$lte": now.Add(-d.intervals[name])}},
+			}},
+		},
+	}, bson.M{"$set": bson.M{
+		"owner":         d.owner,
+		"expiresAt":     now.Add(d.leaseTTL),
+		"lastStartedAt": now,
+	}}, options.Update().SetUpsert(true))
+	// The upsert conflicts with the existing lease when the stage is held by another replica or not yet due
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "failed to acquire lease")
+	}
+	return true, nil
+}
+
+func (d *daemon) renew(ctx context.Context, name string) error {
+	result, err := d.leases().UpdateOne(ctx, bson.M{"_id": name, "owner": d.owner},
+		bson.M{"$set": bson.M{"expiresAt": time.Now().Add(d.leaseTTL)}})
+	if err != nil {
+		return errors.Wrap(err, "failed to renew lease")
+	}
+	if result.MatchedCount == 0 {
+		return errors.Errorf("lease of stage %s was lost", name)
+	}
+	return nil
+}
+
+func (d *daemon) release(ctx context.Context, name string, runErr error) error {
+	now := time.Now()
+	set := bson.M{
+		"owner":          "",
+		"expiresAt":      now,
+		"lastFinishedAt": now,
+		"lastError":      "",
+	}
+	if runErr != nil {
+		set["lastError"] = runErr.Error()
+	} else {
+		set["lastSuccessAt"] = now
+	}
+	_, err := d.leases().UpdateOne(ctx, bson.M{"_id": name, "owner": d.owner}, bson.M{"$set": set})
+	if err != nil {
+		return errors.Wrap(err, "failed to release lease")
+	}
+	return nil
+}
+
+// runStage runs a stage while holding its lease, renewing the lease until the stage finishes.
+// The stage is cancelled if the lease cannot be renewed.
+func (d *daemon) runStage(ctx context.Context, s stage) error {
+	stageCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		ticker := time.NewTicker(d.leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stageCtx.Done():
+				return
+			case <-ticker.C:
+				if err := d.renew(stageCtx, s.Name); err != nil {
+					log.Printf("stopping stage %s: %s\n", s.Name, err)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	// Each run starts with a new client mapping resolver, so that it loads the mappings saved since the last run
+	// and retries the clients that were unresolvable then.
+	d.runner.clientResolver = nil
+	log.Printf("running stage %s\n", s.Name)
+	err := s.Run(stageCtx, d.runner)
+	if err != nil {
+		log.Printf("stage %s failed: %s\n", s.Name, err)
+	} else {
+		log.Printf("stage %s finished\n", s.Name)
+	}
+	return d.release(context.Background(), s.Name, err)
+}
+
+// tick runs every stage that is due, one at a time, in the order of a full run.
+func (d *daemon) tick(ctx context.Context) error {
+	for _, s := range stages {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		acquired, err := d.acquire(ctx, s.Name)
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			continue
+		}
+		err = d.runStage(ctx, s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *daemon) status(ctx context.Context) ([]stageStatus, error) {
+	cursor, err := d.leases().Find(ctx, bson.M{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get stage leases")
+	}
+	defer cursor.Close(ctx)
+	var leases []stageLease
+	err = cursor.All(ctx, &leases)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode stage leases")
+	}
+	byStage := make(map[string]stageLease)
+	for _, lease := range leases {
+		byStage[lease.Stage] = lease
+	}
+	now := time.Now()
+	var statuses []stageStatus
+	for _, s := range stages {
+		lease, ok := byStage[s.Name]
+		if !ok {
+			lease = stageLease{Stage: s.Name}
+		}
+		nextRun := lease.LastFinishedAt.Add(d.intervals[s.Name])
+		if nextRun.Before(now) {
+			nextRun = now
+		}
+		statuses = append(statuses, stageStatus{
+			stageLease: lease,
+			Interval:   d.intervals[s.Name].String(),
+			NextRun:    nextRun,
+			Running:    lease.Owner != "" && lease.ExpiresAt.After(now),
+		})
+	}
+	return statuses, nil
+}
+
+func (d *daemon) serveStatus(w http.ResponseWriter, r *http.Request) {
+	statuses, err := d.status(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statuses)
+}
+
+func intervalFlagName(s stage) string {
+	return s.Name + "-interval"
+}
+
+func daemonCommand() *cli.Command {
+	flags := append(commonFlags(false),
+		&cli.StringFlag{
+			Name:    "status-addr",
+			Usage:   "Address of the HTTP server exposing the last and next run of every stage at /status",
+			EnvVars: []string{"DAEMON_STATUS_ADDR"},
+			Value:   ":8080",
+		},
+		&cli.DurationFlag{
+			Name:    "lease-ttl",
+			Usage:   "How long a stage lease is held without renewal before another replica may take it over",
+			EnvVars: []string{"DAEMON_LEASE_TTL"},
+			Value:   10 * time.Minute,
+		},
+		&cli.DurationFlag{
+			Name:    "poll-interval",
+			Usage:   "How often to check for stages that are due",
+			EnvVars: []string{"DAEMON_POLL_INTERVAL"},
+			Value:   time.Minute,
+		},
+	)
+	for _, s := range stages {
+		flags = append(flags, &cli.DurationFlag{
+			Name:    intervalFlagName(s),
+			Usage:   fmt.Sprintf("How often to run %s", s.Name),
+			EnvVars: []string{strings.ToUpper(strings.ReplaceAll(intervalFlagName(s), "-", "_"))},
+			Value:   s.Interval,
+		})
+	}
+	return &cli.Command{
+		Name:   "daemon",
+		Usage:  "Run the stages on an internal schedule, coordinating with other replicas through leases in the database",
+		Flags:  flags,
+		Action: runDaemon,
+	}
+}
+
+func runDaemon(c *cli.Context) error {
+	ctx := c.Context
+	opts := optionsFromContext(c)
+	if opts.DryRun {
+		return errors.New("dry run is not supported in daemon mode")
+	}
+	r, err := newRunner(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.mg.Disconnect(context.Background())
+	}()
+
+	hostname, _ := os.Hostname()
+	d := &daemon{
+		runner:    r,
+		owner:     fmt.Sprintf("%s-%s", hostname, primitive.NewObjectID().Hex()),
+		intervals: make(map[string]time.Duration),
+		leaseTTL:  c.Duration("lease-ttl"),
+	}
+	for _, s := range stages {
+		d.intervals[s.Name] = c.Duration(intervalFlagName(s))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", d.serveStatus)
+	server := &http.Server{Addr: c.String("status-addr"), Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("status server stopped: %s\n", err)
+		}
+	}()
+	defer func() {
+		_ = server.Shutdown(context.Background())
+	}()
+
+	log.Printf("daemon %s started\n", d.owner)
+	ticker := time.NewTicker(c.Duration("poll-interval"))
+	defer ticker.Stop()
+	for {
+		err = d.tick(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("failed to run scheduled stages: %s\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			log.Println("daemon stopped")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
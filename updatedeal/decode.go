@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// marketDealDecoder reads StateMarketDeals, a JSON object keyed by deal ID, one key-value pair at a time
+// straight into MarketDeal, without going through an intermediate map.
+type marketDealDecoder struct {
+	decoder *json.Decoder
+	started bool
+}
+
+func newMarketDealDecoder(r io.Reader) *marketDealDecoder {
+	return &marketDealDecoder{decoder: json.NewDecoder(r)}
+}
+
+// Next returns the next deal ID and deal. It returns io.EOF once the top level object has been consumed.
+func (d *marketDealDecoder) Next() (string, MarketDeal, error) {
+	if !d.started {
+		token, err := d.decoder.Token()
+		if err != nil {
+			return "", MarketDeal{}, errors.Wrap(err, "failed to read start of object")
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '{' {
+			return "", MarketDeal{}, errors.Errorf("expected start of object, got %v", token)
+		}
+		d.started = true
+	}
+
+	if !d.decoder.More() {
+		token, err := d.decoder.Token()
+		if err != nil {
+			return "", MarketDeal{}, errors.Wrap(err, "failed to read end of object")
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '}' {
+			return "", MarketDeal{}, errors.Errorf("expected end of object, got %v", token)
+		}
+		return "", MarketDeal{}, io.EOF
+	}
+
+	token, err := d.decoder.Token()
+	if err != nil {
+		return "", MarketDeal{}, errors.Wrap(err, "failed to read deal id")
+	}
+	key, ok := token.(string)
+	if !ok {
+		return "", MarketDeal{}, errors.Errorf("expected deal id, got %v", token)
+	}
+	var deal MarketDeal
+	err = d.decoder.Decode(&deal)
+	if err != nil {
+		return "", MarketDeal{}, errors.Wrapf(err, "failed to decode deal %s", key)
+	}
+	return key, deal, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/bcicen/jstream"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+)
+
+const marketDealsFixture = "testdata/StateMarketDeals.json"
+
+type decodedDeal struct {
+	key  string
+	deal MarketDeal
+}
+
+// decodeWithJstream is the decoding path replaced by marketDealDecoder: jstream emits each deal as a generic map,
+// which mapstructure then copies into MarketDeal.
+func decodeWithJstream(r io.Reader, emit func(key string, deal MarketDeal)) error {
+	decoder := jstream.NewDecoder(r, 1).EmitKV()
+	for value := range decoder.Stream() {
+		kv, ok := value.Value.(jstream.KV)
+		if !ok {
+			return errors.New("failed to get key value pair")
+		}
+		var deal MarketDeal
+		// The json tags name the fields the way the removed mapstructure tags did.
+		md, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{TagName: "json", Result: &deal})
+		if err != nil {
+			return err
+		}
+		if err := md.Decode(kv.Value); err != nil {
+			return err
+		}
+		emit(kv.Key, deal)
+	}
+	return decoder.Err()
+}
+
+func decodeWithDecoder(r io.Reader, emit func(key string, deal MarketDeal)) error {
+	decoder := newMarketDealDecoder(r)
+	for {
+		key, deal, err := decoder.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		emit(key, deal)
+	}
+}
+
+func readFixture(tb testing.TB) []byte {
+	data, err := os.ReadFile(marketDealsFixture)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestMarketDealDecoderMatchesJstream(t *testing.T) {
+	data := readFixture(t)
+	var expected, actual []decodedDeal
+	err := decodeWithJstream(bytes.NewReader(data), func(key string, deal MarketDeal) {
+		expected = append(expected, decodedDeal{key, deal})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = decodeWithDecoder(bytes.NewReader(data), func(key string, deal MarketDeal) {
+		actual = append(actual, decodedDeal{key, deal})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(actual) != 500 {
+		t.Fatalf("decoded %d deals, expected the 500 of the fixture", len(actual))
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		for i := range expected {
+			if i < len(actual) && !reflect.DeepEqual(expected[i], actual[i]) {
+				t.Fatalf("deal %d differs:\njstream: %+v\ndecoder: %+v", i, expected[i], actual[i])
+			}
+		}
+		t.Fatalf("decoded %d deals, jstream decoded %d", len(actual), len(expected))
+	}
+}
+
+func TestMarketDealDecoderRejectsNonObject(t *testing.T) {
+	_, _, err := newMarketDealDecoder(bytes.NewReader([]byte(`[1, 2]`))).Next()
+	if err == nil {
+		t.Fatal("expected an error for a top level array")
+	}
+}
+
+func benchmarkDecode(b *testing.B, decode func(io.Reader, func(string, MarketDeal)) error) {
+	data := readFixture(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		err := decode(bytes.NewReader(data), func(string, MarketDeal) {})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMarketDealDecoder(b *testing.B) {
+	benchmarkDecode(b, decodeWithDecoder)
+}
+
+func BenchmarkJstreamMapstructure(b *testing.B) {
+	benchmarkDecode(b, decodeWithJstream)
+}
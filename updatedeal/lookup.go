@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// lookupBatchSize is the number of market deals whose membership is resolved with a single set of queries.
+// Memory used by the lookups is bounded by this number instead of the size of the collections.
+const lookupBatchSize = 1000
+
+type marketDealEntry struct {
+	DealID uint64
+	Deal   MarketDeal
+}
+
+type UnknownDeal struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	Client   string             `bson:"client"`
+	Provider string             `bson:"provider"`
+	PieceCID string             `bson:"pieceCid"`
+	Label    string             `bson:"label"`
+}
+
+type KnownDeal struct {
+	ID    primitive.ObjectID `bson:"_id"`
+	State string             `bson:"state"`
+}
+
+// dealLookup holds the answers to "is this deal known" and "is this piece ours" for one batch of market deals.
+type dealLookup struct {
+	knownDeals   map[uint64]KnownDeal
+	unknownDeals map[string][]UnknownDeal
+	v1CIDs       map[string]struct{}
+	v2CIDs       map[string]struct{}
+}
+
+func unknownDealKey(client string, provider string, pieceCID string) string {
+	return fmt.Sprintf("%s|%s|%s", client, provider, pieceCID)
+}
+
+func newDealLookup(ctx context.Context, updater *dealUpdater, clientResolver *ClientMappingResolver, batch []marketDealEntry) (*dealLookup, error) {
+	dealIDs := make([]uint64, 0, len(batch))
+	pieceCIDSet := make(map[string]struct{}, len(batch))
+	for _, entry := range batch {
+		dealIDs = append(dealIDs, entry.DealID)
+		pieceCIDSet[entry.Deal.Proposal.PieceCID.Root] = struct{}{}
+	}
+	pieceCIDs := make([]string, 0, len(pieceCIDSet))
+	for pieceCID := range pieceCIDSet {
+		pieceCIDs = append(pieceCIDs, pieceCID)
+	}
+
+	mg := updater.mg
+	knownDeals, err := getKnownDeals(ctx, mg, dealIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get known deals")
+	}
+	unknownDeals, err := getUnknownDeals(ctx, mg, clientResolver, pieceCIDs, updater.isClaimed)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get unknown deals")
+	}
+	v1CIDs, v2CIDs, err := getPieceCIDs(ctx, mg, pieceCIDs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get piece cids")
+	}
+	return &dealLookup{
+		knownDeals:   knownDeals,
+		unknownDeals: unknownDeals,
+		v1CIDs:       v1CIDs,
+		v2CIDs:       v2CIDs,
+	}, nil
+}
+
+// takeUnknownDeal returns the oldest unknown deal matching the key and removes it from the lookup,
+// so that the next market deal with the same key is matched against the next proposal.
+func (l *dealLookup) takeUnknownDeal(key string) (UnknownDeal, bool) {
+	unknownDeals, ok := l.unknownDeals[key]
+	if !ok {
+		return UnknownDeal{}, false
+	}
+	if len(unknownDeals) == 1 {
+		delete(l.unknownDeals, key)
+	} else {
+		l.unknownDeals[key] = unknownDeals[1:]
+	}
+	return unknownDeals[0], true
+}
+
+func getPieceCIDs(ctx context.Context, mg *mongo.Client, pieceCIDs []string) (map[string]struct{}, map[string]struct{}, error) {
+	v1 := make(map[string]struct{})
+	v2 := make(map[string]struct{})
+	if len(pieceCIDs) == 0 {
+		return v1, v2, nil
+	}
+	result, err := mg.Database("singularity").Collection("cars").Aggregate(ctx, bson.A{
+		bson.M{
+			"$match": bson.M{
+				"pieceCid": bson.M{"$in": pieceCIDs},
+			},
+		},
+		bson.M{
+			"$group": bson.M{
+				"_id": bson.M{
+					"isV1":     "$isV1",
+					"pieceCid": "$pieceCid",
+				},
+			},
+		},
+		bson.M{
+			"$project": bson.M{
+				"isV1":     "$_id.isV1",
+				"pieceCid": "$_id.pieceCid",
+			},
+		},
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to query cars")
+	}
+	defer result.Close(ctx)
+	var cars []struct {
+		IsV1     bool   `bson:"isV1"`
+		PieceCID string `bson:"pieceCid"`
+	}
+	if err := result.All(ctx, &cars); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to decode cars")
+	}
+	for _, car := range cars {
+		if car.IsV1 {
+			v1[car.PieceCID] = struct{}{}
+		} else {
+			v2[car.PieceCID] = struct{}{}
+		}
+	}
+	return v1, v2, nil
+}
+
+func getUnknownDeals(ctx context.Context, mg *mongo.Client, clientResolver *ClientMappingResolver, pieceCIDs []string, skip func(primitive.ObjectID) bool) (map[string][]UnknownDeal, error) {
+	unknownDealsMap := make(map[string][]UnknownDeal)
+	if len(pieceCIDs) == 0 {
+		return unknownDealsMap, nil
+	}
+	result, err := mg.Database("singularity").Collection(dealsCollection).Find(ctx,
+		bson.M{"dealId": bson.M{"$exists": false}, "pieceCid": bson.M{"$in": pieceCIDs}},
+		&options.FindOptions{
+			Projection: bson.M{
+				"_id":      1,
+				"client":   1,
+				"provider": 1,
+				"pieceCid": 1,
+				"label":    1,
+			},
+			Sort: bson.M{"createdAt": 1},
+		})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to find unknown deals")
+	}
+	defer result.Close(ctx)
+	var deals []UnknownDeal
+	err = result.All(ctx, &deals)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to scan unknown deals")
+	}
+
+	for _, v := range deals {
+		if skip(v.ID) {
+			continue
+		}
+		client, err := clientResolver.Get(ctx, v.Client)
+		if errors.Is(err, errNotFound) {
+			key := unknownDealKey(v.Client, v.Provider, v.PieceCID)
+			unknownDealsMap[key] = append(unknownDealsMap[key], v)
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to resolve client")
+		}
+		key := unknownDealKey(client.ActorID, v.Provider, v.PieceCID)
+		unknownDealsMap[key] = append(unknownDealsMap[key], v)
+	}
+	return unknownDealsMap, nil
+}
+
+func getKnownDeals(ctx context.Context, mg *mongo.Client, dealIDs []uint64) (map[uint64]KnownDeal, error) {
+	var ids = make(map[uint64]KnownDeal)
+	if len(dealIDs) == 0 {
+		return ids, nil
+	}
+	var r []struct {
+		ID     primitive.ObjectID `bson:"_id"`
+		DealID uint64             `bson:"dealId"`
+		State  string             `bson:"state"`
+	}
+	result, err := mg.Database("singularity").Collection(dealsCollection).Find(
+		ctx,
+		bson.M{"dealId": bson.M{"$in": dealIDs}},
+		&options.FindOptions{
+			Projection: bson.M{"dealId": 1, "state": 1},
+		})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get known deal ids")
+	}
+	defer result.Close(ctx)
+	err = result.All(ctx, &r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to scan known deal ids")
+	}
+	for _, v := range r {
+		ids[v.DealID] = KnownDeal{
+			ID:    v.ID,
+			State: v.State,
+		}
+	}
+	return ids, nil
+}
+
+// processBatch resolves the membership of a batch of market deals and applies the resulting updates.
+func processBatch(ctx context.Context, updater *dealUpdater, clientResolver *ClientMappingResolver, batch []marketDealEntry) error {
+	lookup, err := newDealLookup(ctx, updater, clientResolver, batch)
+	if err != nil {
+		return errors.Wrap(err, "failed to look up batch")
+	}
+	for _, entry := range batch {
+		dealIdNum, deal := entry.DealID, entry.Deal
+
+		// If the deal is already in the list, check if it needs to be updated
+		if knownDeal, ok := lookup.knownDeals[dealIdNum]; ok {
+			err = updater.updateDeal(ctx, knownDeal.ID, knownDeal.State, dealIdNum, deal)
+			if err != nil {
+				return errors.Wrap(err, "failed to update deal")
+			}
+			continue
+		}
+
+		key := unknownDealKey(deal.Proposal.Client, deal.Proposal.Provider, deal.Proposal.PieceCID.Root)
+		if unknownDeal, ok := lookup.takeUnknownDeal(key); ok {
+			err = updater.updateDeal(ctx, unknownDeal.ID, "proposed", dealIdNum, deal)
+			if err != nil {
+				return errors.Wrap(err, "failed to mark deal active")
+			}
+			continue
+		}
+
+		if _, ok := lookup.v2CIDs[deal.Proposal.PieceCID.Root]; ok {
+			err = updater.saveDealAsExternal(ctx, dealIdNum, deal, false)
+			if err != nil {
+				return errors.Wrap(err, "failed to save deal as external")
+			}
+			continue
+		}
+
+		if _, ok := lookup.v1CIDs[deal.Proposal.PieceCID.Root]; ok {
+			err = updater.saveDealAsExternal(ctx, dealIdNum, deal, true)
+			if err != nil {
+				return errors.Wrap(err, "failed to save deal as external")
+			}
+			continue
+		}
+	}
+	log.Printf("processed batch of %d deals\n", len(batch))
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/data-preservation-programs/singularity-metrics/schema"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// benchInstance marks the documents seeded by the benchmark, so that it refuses to run against real data.
+const benchInstance = "lookup-benchmark"
+
+// benchAccountKeyPrefix marks the client mappings seeded by the benchmark.
+const benchAccountKeyPrefix = "f1bench"
+
+func benchPieceCID(i int) string {
+	return fmt.Sprintf("baga6ea4seaqbench%012d", i)
+}
+
+func benchClient(i int) string {
+	return fmt.Sprintf("f0%d", 100000+i%1000)
+}
+
+// seedLookupBenchmark fills the database with a car and a deal for each piece, every tenth deal being
+// not yet matched to a deal ID, and with the client mappings of the deals. Seeding is skipped if it was already done.
+func seedLookupBenchmark(ctx context.Context, b *testing.B, db *mongo.Database, pieces int) {
+	// The lookups read the singularity database, so the benchmark refuses to replace anything it did not seed.
+	for collection, foreign := range map[string]bson.M{
+		"cars":    {"instanceId": bson.M{"$ne": benchInstance}},
+		"deals":   {"instanceId": bson.M{"$ne": benchInstance}},
+		"clients": {"accountKey": bson.M{"$not": bson.M{"$regex": "^" + benchAccountKeyPrefix}}},
+	} {
+		count, err := db.Collection(collection).CountDocuments(ctx, foreign, options.Count().SetLimit(1))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if count > 0 {
+			b.Fatalf("MONGODB_BENCH_URI must point to a disposable server, the %s collection holds real data", collection)
+		}
+	}
+	seeded, err := db.Collection("cars").EstimatedDocumentCount(ctx)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if seeded == int64(pieces) {
+		return
+	}
+	for _, collection := range []string{"cars", "deals", "clients"} {
+		if err := db.Collection(collection).Drop(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := schema.EnsureIndexes(ctx, db, "cars", "deals", "clients"); err != nil {
+		b.Fatal(err)
+	}
+	clients := make([]any, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		clients = append(clients, model.ClientMapping{ActorID: benchClient(i), AccountKey: benchAccountKeyPrefix + strconv.Itoa(i)})
+	}
+	if _, err := db.Collection("clients").InsertMany(ctx, clients); err != nil {
+		b.Fatal(err)
+	}
+	const batch = 10000
+	createdAt := time.Now().UTC()
+	for start := 0; start < pieces; start += batch {
+		cars := make([]any, 0, batch)
+		deals := make([]any, 0, batch)
+		for i := start; i < start+batch && i < pieces; i++ {
+			reporter := model.Reporter{IsV1: i%2 == 0, InstanceID: benchInstance}
+			cars = append(cars, model.Car{Reporter: reporter, CreatedAt: createdAt, PieceCID: benchPieceCID(i), PieceSize: 1 << 35})
+			deal := model.Deal{Reporter: reporter, CreatedAt: createdAt, Client: benchClient(i), Provider: "f01000",
+				PieceCID: benchPieceCID(i), PieceSize: 1 << 35, State: "proposed"}
+			if i%10 != 0 {
+				dealID := uint64(i)
+				deal.DealID = &dealID
+				deal.State = "active"
+			}
+			deals = append(deals, deal)
+		}
+		if _, err := db.Collection("cars").InsertMany(ctx, cars, options.InsertMany().SetOrdered(false)); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := db.Collection("deals").InsertMany(ctx, deals, options.InsertMany().SetOrdered(false)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDealLookup measures the lookups of one batch of market deals against a database of
+// LOOKUP_BENCH_PIECES pieces, 10 million by default. The lookups rely on the indexes declared in schema.Indexes,
+// which the runner ensures before syncing.
+//
+//	MONGODB_BENCH_URI=mongodb://localhost:27017 go test ./updatedeal -run '^$' -bench DealLookup -timeout 2h
+func BenchmarkDealLookup(b *testing.B) {
+	uri := os.Getenv("MONGODB_BENCH_URI")
+	if uri == "" {
+		b.Skip("MONGODB_BENCH_URI is not set")
+	}
+	pieces := 10_000_000
+	if value := os.Getenv("LOOKUP_BENCH_PIECES"); value != "" {
+		var err error
+		if pieces, err = strconv.Atoi(value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	ctx := context.Background()
+	mg, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = mg.Disconnect(context.Background())
+	}()
+	seedLookupBenchmark(ctx, b, mg.Database("singularity"), pieces)
+
+	clientResolver, err := NewClientMappingResolver(ctx, mg, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	updater := newDealUpdater(mg, true)
+	rnd := rand.New(rand.NewSource(1))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		batch := make([]marketDealEntry, 0, lookupBatchSize)
+		for i := 0; i < lookupBatchSize; i++ {
+			// Half of the market deals are pieces we do not know.
+			piece := rnd.Intn(pieces * 2)
+			batch = append(batch, marketDealEntry{DealID: uint64(piece), Deal: MarketDeal{Proposal: DealProposal{
+				PieceCID: Cid{Root: benchPieceCID(piece)},
+				Client:   benchClient(piece),
+				Provider: "f01000",
+			}}})
+		}
+		b.StartTimer()
+		_, err := newDealLookup(ctx, updater, clientResolver, batch)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -22,7 +22,7 @@ func (deal MarketDeal) getState() string {
 }
 
 type Cid struct {
-	Root string `json:"/" mapstructure:"/"`
+	Root string `json:"/"`
 }
 
 type DealProposal struct {
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+type pipelineResult struct {
+	entry marketDealEntry
+	err   error
+}
+
+type pipelineItem struct {
+	key  string
+	deal MarketDeal
+	done chan pipelineResult
+}
+
+func prepareMarketDeal(ctx context.Context, clientResolver *ClientMappingResolver, key string, deal MarketDeal) (marketDealEntry, error) {
+	dealIdNum, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return marketDealEntry{}, errors.Wrap(err, "failed to parse deal id")
+	}
+
+	// Save the result to database anyway
+	_, _ = clientResolver.Get(ctx, deal.Proposal.Client)
+
+	return marketDealEntry{DealID: dealIdNum, Deal: deal}, nil
+}
+
+// syncMarketDeals streams StateMarketDeals from r through a pipeline of a single decoder,
+// a bounded pool of workers that parse deal IDs and resolve clients, and a single writer that
+// applies the deals in the order they appear in the stream.
+func syncMarketDeals(ctx context.Context, updater *dealUpdater, clientResolver *ClientMappingResolver, r io.Reader, concurrency int) error {
+	g, ctx := errgroup.WithContext(ctx)
+	jobs := make(chan *pipelineItem, concurrency)
+	// The ordered queue bounds the number of deals in flight between the decoder and the writer.
+	ordered := make(chan *pipelineItem, concurrency*16)
+
+	g.Go(func() error {
+		defer close(jobs)
+		defer close(ordered)
+		decoder := newMarketDealDecoder(r)
+		for {
+			key, deal, err := decoder.Next()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrap(err, "failed to decode state market deals")
+			}
+			item := &pipelineItem{
+				key:  key,
+				deal: deal,
+				done: make(chan pipelineResult, 1),
+			}
+			select {
+			case ordered <- item:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			select {
+			case jobs <- item:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+
+	for i := 0; i < concurrency; i++ {
+		g.Go(func() error {
+			for item := range jobs {
+				entry, err := prepareMarketDeal(ctx, clientResolver, item.key, item.deal)
+				item.done <- pipelineResult{entry: entry, err: err}
+			}
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		batch := make([]marketDealEntry, 0, lookupBatchSize)
+		for item := range ordered {
+			var result pipelineResult
+			select {
+			case result = <-item.done:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if result.err != nil {
+				return result.err
+			}
+			batch = append(batch, result.entry)
+			if len(batch) < lookupBatchSize {
+				continue
+			}
+			err := processBatch(ctx, updater, clientResolver, batch)
+			if err != nil {
+				return errors.Wrap(err, "failed to process batch")
+			}
+			batch = batch[:0]
+		}
+		if len(batch) > 0 {
+			err := processBatch(ctx, updater, clientResolver, batch)
+			if err != nil {
+				return errors.Wrap(err, "failed to process batch")
+			}
+		}
+		return nil
+	})
+
+	return g.Wait()
+}
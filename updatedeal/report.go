@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// changeReport summarizes the changes made, or planned in dry run mode, by a deal sync.
+type changeReport struct {
+	mu          sync.Mutex
+	DryRun      bool             `json:"dryRun"`
+	Inserts     map[string]int64 `json:"inserts"`
+	Transitions map[string]int64 `json:"transitions"`
+	Expiries    map[string]int64 `json:"expiries"`
+}
+
+func newChangeReport(dryRun bool) *changeReport {
+	return &changeReport{
+		DryRun:      dryRun,
+		Inserts:     make(map[string]int64),
+		Transitions: make(map[string]int64),
+		Expiries:    make(map[string]int64),
+	}
+}
+
+func (r *changeReport) addInsert(isV1 bool, state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	version := "v2"
+	if isV1 {
+		version = "v1"
+	}
+	r.Inserts[version+"/"+state]++
+}
+
+func (r *changeReport) addTransition(from string, to string, count int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Transitions[from+"→"+to] += count
+}
+
+func (r *changeReport) addExpiry(state string, count int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Expiries[state] += count
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Write renders the report as "json" or as a "text" table.
+func (r *changeReport) Write(w io.Writer, format string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return errors.Wrap(encoder.Encode(r), "failed to encode report")
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "CHANGE\tKIND\tCOUNT\n")
+		for _, k := range sortedKeys(r.Inserts) {
+			fmt.Fprintf(tw, "insert external\t%s\t%d\n", k, r.Inserts[k])
+		}
+		for _, k := range sortedKeys(r.Transitions) {
+			fmt.Fprintf(tw, "transition\t%s\t%d\n", k, r.Transitions[k])
+		}
+		for _, k := range sortedKeys(r.Expiries) {
+			fmt.Fprintf(tw, "expiry\t%s\t%d\n", k, r.Expiries[k])
+		}
+		return errors.Wrap(tw.Flush(), "failed to write report")
+	default:
+		return errors.Errorf("unknown report format %q", format)
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/dataset"
+	"github.com/data-preservation-programs/singularity-metrics/geoip"
+	"github.com/data-preservation-programs/singularity-metrics/instance"
+	"github.com/data-preservation-programs/singularity-metrics/retention"
+	"github.com/data-preservation-programs/singularity-metrics/schema"
+	"github.com/data-preservation-programs/singularity-metrics/scorecard"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type runOptions struct {
+	MongoURI     string
+	Concurrency  int
+	DryRun       bool
+	ReportFormat string
+}
+
+// runner holds the state shared by the stages of a single invocation.
+type runner struct {
+	opts    runOptions
+	mg      *mongo.Client
+	updater *dealUpdater
+	// clientResolver is created by the first stage that needs it. The daemon clears it before every stage run,
+	// since its caches are never refreshed.
+	clientResolver *ClientMappingResolver
+}
+
+type stage struct {
+	Name  string
+	Usage string
+	// Interval is the default time between two runs of the stage in daemon mode.
+	Interval time.Duration
+	Run      func(ctx context.Context, r *runner) error
+}
+
+// stages lists the stages of a full run, in the order they are run by the "all" command.
+var stages = []stage{
+	{
+		Name:     "sync-verified-clients",
+		Usage:    "Sync the verified client list from datacapstats",
+		Interval: 24 * time.Hour,
+		Run:      syncVerifiedClients,
+	},
+	{
+		Name:     "resolve-clients",
+		Usage:    "Resolve the actor ID and account key of the deal clients without a mapping",
+		Interval: 6 * time.Hour,
+		Run:      resolveClients,
+	},
+	{
+		Name:     "sync-deals",
+		Usage:    "Sync deal states from StateMarketDeals",
+		Interval: 6 * time.Hour,
+		Run:      syncDeals,
+	},
+	{
+		Name:     "expire",
+		Usage:    "Mark expired deals and expired proposals",
+		Interval: time.Hour,
+		Run:      expire,
+	},
+	{
+		Name:     "refresh-datasets",
+		Usage:    "Recompute dataset totals and record their onboarding progress",
+		Interval: 6 * time.Hour,
+		Run:      refreshDatasets,
+	},
+	{
+		Name:     "rebuild-instances",
+		Usage:    "Rebuild the instance registry from every reported car and deal",
+		Interval: 24 * time.Hour,
+		Run:      rebuildInstances,
+	},
+	{
+		Name:     "refresh-scorecards",
+		Usage:    "Recompute the provider scorecards",
+		Interval: 6 * time.Hour,
+		Run:      refreshScorecards,
+	},
+	{
+		Name:     "enrich-geoip",
+		Usage:    "Add the location of their reporter to cars and deals stored before GeoIP enrichment",
+		Interval: 24 * time.Hour,
+		Run:      enrichGeoIP,
+	},
+	{
+		Name:     "apply-ip-retention",
+		Usage:    "Truncate the IPs of records older than the IP retention period",
+		Interval: 24 * time.Hour,
+		Run:      applyIPRetention,
+	},
+}
+
+func newRunner(ctx context.Context, opts runOptions) (*runner, error) {
+	if opts.ReportFormat != "text" && opts.ReportFormat != "json" {
+		return nil, errors.Errorf("unknown report format %q", opts.ReportFormat)
+	}
+	if opts.Concurrency < 1 {
+		return nil, errors.Errorf("concurrency must be positive, got %d", opts.Concurrency)
+	}
+	mg, err := mongo.Connect(ctx, options.Client().ApplyURI(opts.MongoURI))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to mongo")
+	}
+	if !opts.DryRun {
+		// Without the unique indexes, the sync could insert duplicate deals and client mappings, so it does not
+		// run. The error names the duplicate key of a unique index that could not be built, and "schema indexes"
+		// lists the indexes that are still missing.
+		err = schema.EnsureIndexes(ctx, mg.Database("singularity"))
+		if err != nil {
+			_ = mg.Disconnect(context.Background())
+			return nil, errors.Wrap(err, "failed to ensure indexes")
+		}
+	}
+	return &runner{
+		opts:    opts,
+		mg:      mg,
+		updater: newDealUpdater(mg, opts.DryRun),
+	}, nil
+}
+
+// runStages runs the given stages in order and prints the change report in dry run mode.
+func runStages(ctx context.Context, opts runOptions, stages ...stage) error {
+	r, err := newRunner(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = r.mg.Disconnect(context.Background())
+	}()
+	for _, s := range stages {
+		log.Printf("running stage %s\n", s.Name)
+		err = s.Run(ctx, r)
+		if err != nil {
+			return errors.Wrapf(err, "stage %s failed", s.Name)
+		}
+	}
+	if opts.DryRun {
+		return r.updater.report.Write(os.Stdout, opts.ReportFormat)
+	}
+	return nil
+}
+
+func (r *runner) resolver(ctx context.Context) (*ClientMappingResolver, error) {
+	if r.clientResolver != nil {
+		return r.clientResolver, nil
+	}
+	clientResolver, err := NewClientMappingResolver(ctx, r.mg, r.opts.DryRun)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create client mapping resolver")
+	}
+	r.clientResolver = clientResolver
+	return clientResolver, nil
+}
+
+func syncVerifiedClients(ctx context.Context, r *runner) error {
+	if r.opts.DryRun {
+		log.Println("dry run: skipping verified clients update")
+		return nil
+	}
+	return updateVerifiedClients(ctx, r.mg)
+}
+
+// unmappedClients lists the deal clients that have no mapping yet, neither by actor ID nor by account key.
+func unmappedClients(ctx context.Context, mg *mongo.Client) ([]string, error) {
+	cursor, err := mg.Database("singularity").Collection(dealsCollection).Aggregate(ctx, bson.A{
+		bson.M{"$group": bson.M{"_id": "$client"}},
+		bson.M{"$match": bson.M{"_id": bson.M{"$nin": bson.A{nil, ""}}}},
+		bson.M{"$lookup": bson.M{"from": "clients", "localField": "_id", "foreignField": "actorId", "as": "byActor"}},
+		bson.M{"$lookup": bson.M{"from": "clients", "localField": "_id", "foreignField": "accountKey", "as": "byAccountKey"}},
+		bson.M{"$match": bson.M{"byActor": bson.M{"$size": 0}, "byAccountKey": bson.M{"$size": 0}}},
+		bson.M{"$project": bson.M{"_id": 1}},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get unmapped deal clients")
+	}
+	var rows []struct {
+		Client string `bson:"_id"`
+	}
+	err = cursor.All(ctx, &rows)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode unmapped deal clients")
+	}
+	clients := make([]string, 0, len(rows))
+	for _, row := range rows {
+		clients = append(clients, row.Client)
+	}
+	return clients, nil
+}
+
+func resolveClients(ctx context.Context, r *runner) error {
+	clientResolver, err := r.resolver(ctx)
+	if err != nil {
+		return err
+	}
+	clients, err := unmappedClients(ctx, r.mg)
+	if err != nil {
+		return err
+	}
+	var unresolvable int
+	for _, client := range clients {
+		_, err = clientResolver.Get(ctx, client)
+		if errors.Is(err, errNotFound) {
+			unresolvable++
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to resolve client")
+		}
+	}
+	log.Printf("resolved %d unmapped clients, %d unresolvable\n", len(clients)-unresolvable, unresolvable)
+	return nil
+}
+
+func syncDeals(ctx context.Context, r *runner) error {
+	clientResolver, err := r.resolver(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx,
+		http.MethodGet,
+		"https://marketdeals.s3.amazonaws.com/StateMarketDeals.json.zst",
+		nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to make request")
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to get state market deals: %s", resp.Status)
+	}
+
+	decompressor, err := zstd.NewReader(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed to create decompressor")
+	}
+
+	defer decompressor.Close()
+
+	err = syncMarketDeals(ctx, r.updater, clientResolver, decompressor, r.opts.Concurrency)
+	if err != nil {
+		return errors.Wrap(err, "failed to sync state market deals")
+	}
+	return nil
+}
+
+func expire(ctx context.Context, r *runner) error {
+	return r.updater.expireDeals(ctx)
+}
+
+func refreshDatasets(ctx context.Context, r *runner) error {
+	if r.opts.DryRun {
+		log.Println("dry run: skipping dataset refresh")
+		return nil
+	}
+	_, err := dataset.Refresh(ctx, r.mg.Database("singularity"))
+	return err
+}
+
+func rebuildInstances(ctx context.Context, r *runner) error {
+	if r.opts.DryRun {
+		log.Println("dry run: skipping instance rebuild")
+		return nil
+	}
+	_, err := instance.Rebuild(ctx, r.mg.Database("singularity"))
+	return err
+}
+
+func refreshScorecards(ctx context.Context, r *runner) error {
+	if r.opts.DryRun {
+		log.Println("dry run: skipping scorecard refresh")
+		return nil
+	}
+	_, err := scorecard.Refresh(ctx, r.mg.Database("singularity"))
+	return err
+}
+
+// applyIPRetention applies the policy read from IP_RETENTION_DAYS, IPV4_PREFIX_BITS and IPV6_PREFIX_BITS.
+func applyIPRetention(ctx context.Context, r *runner) error {
+	if r.opts.DryRun {
+		log.Println("dry run: skipping IP retention")
+		return nil
+	}
+	policy, err := retention.PolicyFromEnv()
+	if err != nil {
+		return errors.Wrap(err, "invalid IP retention policy")
+	}
+	_, err = retention.Apply(ctx, r.mg.Database("singularity"), policy)
+	return err
+}
+
+// enrichGeoIP backfills locations from the databases named by GEOIP_DB and GEOIP_ASN_DB.
+func enrichGeoIP(ctx context.Context, r *runner) error {
+	if r.opts.DryRun {
+		log.Println("dry run: skipping GeoIP enrichment")
+		return nil
+	}
+	resolver, err := geoip.OpenFromEnv()
+	if err != nil {
+		return err
+	}
+	if resolver == nil {
+		log.Println("GEOIP_DB and GEOIP_ASN_DB are not set, skipping GeoIP enrichment")
+		return nil
+	}
+	defer resolver.Close()
+	return geoip.Backfill(ctx, r.mg.Database("singularity"), resolver)
+}
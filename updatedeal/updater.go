@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// dealUpdater applies the changes found by the deal sync to the deals collection and records them in a report.
+// In dry run mode the changes are only recorded and nothing is written.
+type dealUpdater struct {
+	mg     *mongo.Client
+	dryRun bool
+	report *changeReport
+	// claimed holds the proposals matched to a market deal during a dry run. Since the match is not written,
+	// they would otherwise be returned as unknown deals again by the lookups of later batches.
+	claimed map[primitive.ObjectID]struct{}
+}
+
+func newDealUpdater(mg *mongo.Client, dryRun bool) *dealUpdater {
+	return &dealUpdater{
+		mg:      mg,
+		dryRun:  dryRun,
+		report:  newChangeReport(dryRun),
+		claimed: make(map[primitive.ObjectID]struct{}),
+	}
+}
+
+func (u *dealUpdater) isClaimed(id primitive.ObjectID) bool {
+	_, ok := u.claimed[id]
+	return ok
+}
+
+func (u *dealUpdater) saveDealAsExternal(ctx context.Context, dealID uint64, deal MarketDeal, isV1 bool) error {
+	price, err := strconv.ParseFloat(deal.Proposal.StoragePricePerEpoch, 64)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse storage price per epoch")
+	}
+	// convert from attoFIL per epoch to FIL per GiB per epoch
+	price = price / 1e18 / float64(deal.Proposal.PieceSize) * (1 << 30)
+	var state = deal.getState()
+	d := model.Deal{
+		Reporter: model.Reporter{
+			IsV1:       isV1,
+			InstanceID: "external",
+		},
+		CreatedAt:        epochToTimestamp(deal.Proposal.StartEpoch),
+		DealID:           &dealID,
+		Client:           deal.Proposal.Client,
+		Provider:         deal.Proposal.Provider,
+		Label:            deal.Proposal.Label,
+		PieceCID:         deal.Proposal.PieceCID.Root,
+		PieceSize:        int64(deal.Proposal.PieceSize),
+		State:            state,
+		StartEpoch:       &deal.Proposal.StartEpoch,
+		SectorStartEpoch: &deal.State.SectorStartEpoch,
+		Duration:         deal.Proposal.EndEpoch - deal.Proposal.StartEpoch,
+		EndEpoch:         &deal.Proposal.EndEpoch,
+		Verified:         deal.Proposal.VerifiedDeal,
+		Price:            price,
+	}
+	u.report.addInsert(isV1, state)
+	if u.dryRun {
+		return nil
+	}
+	if _, err := u.mg.Database("singularity").Collection(dealsCollection).InsertOne(ctx, d); err != nil {
+		return errors.Wrap(err, "failed to insert deal")
+	}
+	log.Printf("saved deal %d as external\n", dealID)
+	return nil
+}
+
+func (u *dealUpdater) updateDeal(ctx context.Context, id primitive.ObjectID, state string, dealID uint64, marketDeal MarketDeal) error {
+	var newState = marketDeal.getState()
+	if state == newState {
+		return nil
+	}
+	u.report.addTransition(state, newState, 1)
+	if u.dryRun {
+		u.claimed[id] = struct{}{}
+		return nil
+	}
+	// The publish epoch is not part of the market deal, so the first sync that finds the deal on chain
+	// stands in for it. A deal cannot be published after it is activated.
+	publishedAt := time.Now().UTC()
+	if marketDeal.State.SectorStartEpoch > 0 {
+		if activatedAt := epochToTimestamp(marketDeal.State.SectorStartEpoch); activatedAt.Before(publishedAt) {
+			publishedAt = activatedAt
+		}
+	}
+	result, err := u.mg.Database("singularity").Collection(dealsCollection).UpdateOne(ctx, bson.M{
+		"_id": id,
+	}, bson.M{
+		"$min": bson.M{"publishedAt": publishedAt},
+		"$set": bson.M{
+			"state":            newState,
+			"dealId":           dealID,
+			"startEpoch":       marketDeal.Proposal.StartEpoch,
+			"sectorStartEpoch": marketDeal.State.SectorStartEpoch,
+			"endEpoch":         marketDeal.Proposal.EndEpoch,
+			"duration":         marketDeal.Proposal.EndEpoch - marketDeal.Proposal.StartEpoch,
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to update deal")
+	}
+	if result.MatchedCount == 0 {
+		return errors.Errorf("deal not found %s", id)
+	} else {
+		log.Printf("update state for deal %d: %s\n", dealID, newState)
+	}
+	return nil
+}
+
+// markExpired moves deals matching the filter to newState and records them as expiries. In dry run mode the
+// matching deals are counted instead. The count does not account for state changes planned earlier in the same
+// dry run, since those are not written.
+func (u *dealUpdater) markExpired(ctx context.Context, filter bson.M, newState string) (int64, error) {
+	collection := u.mg.Database("singularity").Collection(dealsCollection)
+	var count int64
+	if u.dryRun {
+		var err error
+		count, err = collection.CountDocuments(ctx, filter)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to count deals")
+		}
+	} else {
+		result, err := collection.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"state": newState}})
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to update deals")
+		}
+		count = result.ModifiedCount
+	}
+	u.report.addExpiry(newState, count)
+	return count, nil
+}
+
+func (u *dealUpdater) expireDeals(ctx context.Context) error {
+	currentEpoch := yesterdayEpoch()
+	expired, err := u.markExpired(ctx, bson.M{"state": "active", "endEpoch": bson.M{"$lt": currentEpoch}}, "expired")
+	if err != nil {
+		return errors.Wrap(err, "failed to mark expired deals")
+	}
+	log.Printf("marked %d deals as expired\n", expired)
+	proposalExpired, err := u.markExpired(ctx, bson.M{"state": bson.M{"$in": bson.A{"proposed", "published"}}, "$or": bson.A{
+		bson.M{"startEpoch": bson.M{"$lt": currentEpoch, "$gt": 0}},
+		bson.M{"createdAt": bson.M{"$lt": time.Now().Add(-time.Hour * 24 * 30)}},
+	}}, "proposal_expired")
+	if err != nil {
+		return errors.Wrap(err, "failed to mark expired proposal deals")
+	}
+	log.Printf("marked %d proposal deals as expired\n", proposalExpired)
+	return nil
+}
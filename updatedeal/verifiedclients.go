@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/data-preservation-programs/singularity-metrics/model"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	verifiedClientsCollection       = "verifiedClients"
+	verifiedClientHistoryCollection = "verifiedClientHistory"
+	verifiedClientsPageSize         = 1000
+)
+
+type VerifiedClientResponse struct {
+	ID               int32             `json:"id"`
+	AddressID        string            `json:"addressId"`
+	Address          string            `json:"address"`
+	Name             string            `json:"name"`
+	OrgName          string            `json:"orgName"`
+	Region           string            `json:"region"`
+	Website          string            `json:"website"`
+	Industry         string            `json:"industry"`
+	InitialAllowance string            `json:"initialAllowance"`
+	AllowanceArray   []model.Allowance `json:"allowanceArray"`
+}
+
+func (v VerifiedClientResponse) toVerifiedClient() model.VerifiedClient {
+	entry := model.VerifiedClient{
+		ID:               v.ID,
+		AddressID:        v.AddressID,
+		Address:          v.Address,
+		Name:             v.Name,
+		OrgName:          v.OrgName,
+		Region:           v.Region,
+		Website:          v.Website,
+		Industry:         v.Industry,
+		InitialAllowance: v.InitialAllowance,
+		Allowances:       v.AllowanceArray,
+	}
+	for _, a := range v.AllowanceArray {
+		if strings.HasPrefix(a.AuditTrail, "https://") {
+			entry.AuditTrail = a.AuditTrail
+			break
+		}
+	}
+	return entry
+}
+
+// sameVerifiedClient compares the content of two entries, ignoring the fields maintained by the sync.
+func sameVerifiedClient(a model.VerifiedClient, b model.VerifiedClient) bool {
+	for _, v := range []*model.VerifiedClient{&a, &b} {
+		v.Version = 0
+		v.UpdatedAt = time.Time{}
+		if len(v.Allowances) == 0 {
+			v.Allowances = nil
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// fetchVerifiedClients returns a page of verified clients and the total number of clients reported by the API, or -1
+// if the response has no count.
+func fetchVerifiedClients(ctx context.Context, page int) ([]VerifiedClientResponse, int, error) {
+	url := fmt.Sprintf("https://api.datacapstats.io/api/getVerifiedClients?limit=%d&page=%d", verifiedClientsPageSize, page)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to create request")
+	}
+	result, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to get verified clients")
+	}
+	defer result.Body.Close()
+	if result.StatusCode != http.StatusOK {
+		return nil, 0, errors.Errorf("failed to get verified clients: %s", result.Status)
+	}
+	var respBody struct {
+		Data  []VerifiedClientResponse `json:"data"`
+		Count json.Number              `json:"count"`
+	}
+	err = json.NewDecoder(result.Body).Decode(&respBody)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to decode response")
+	}
+	if respBody.Count == "" {
+		return respBody.Data, -1, nil
+	}
+	count, err := respBody.Count.Int64()
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to parse verified client count")
+	}
+	return respBody.Data, int(count), nil
+}
+
+// saveVerifiedClientVersion writes the entry as the next version of the client and records it in the history.
+func saveVerifiedClientVersion(ctx context.Context, mg *mongo.Client, entry model.VerifiedClient, change string) error {
+	db := mg.Database("singularity")
+	_, err := db.Collection(verifiedClientsCollection).UpdateOne(ctx,
+		bson.M{"id": entry.ID}, bson.M{"$set": entry}, options.Update().SetUpsert(true))
+	if err != nil {
+		return errors.Wrap(err, "failed to update verified client")
+	}
+	_, err = db.Collection(verifiedClientHistoryCollection).InsertOne(ctx, model.VerifiedClientVersion{
+		ClientID:  entry.ID,
+		Version:   entry.Version,
+		Change:    change,
+		ChangedAt: entry.UpdatedAt,
+		Client:    entry,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to insert verified client history")
+	}
+	log.Printf("%s verified client %d, version %d\n", change, entry.ID, entry.Version)
+	return nil
+}
+
+func syncVerifiedClient(ctx context.Context, mg *mongo.Client, entry model.VerifiedClient, now time.Time) error {
+	var existing model.VerifiedClient
+	err := mg.Database("singularity").Collection(verifiedClientsCollection).FindOne(ctx, bson.M{"id": entry.ID}).Decode(&existing)
+	change := "updated"
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		change = "created"
+	case err != nil:
+		return errors.Wrap(err, "failed to get verified client")
+	case existing.Removed:
+		change = "restored"
+	case sameVerifiedClient(existing, entry):
+		return nil
+	}
+	entry.Version = existing.Version + 1
+	entry.UpdatedAt = now
+	return saveVerifiedClientVersion(ctx, mg, entry, change)
+}
+
+// markRemovedVerifiedClients flags the clients that were not returned by the source.
+func markRemovedVerifiedClients(ctx context.Context, mg *mongo.Client, seen map[int32]struct{}, now time.Time) error {
+	cursor, err := mg.Database("singularity").Collection(verifiedClientsCollection).Find(ctx, bson.M{"removed": bson.M{"$ne": true}})
+	if err != nil {
+		return errors.Wrap(err, "failed to get verified clients")
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var entry model.VerifiedClient
+		err = cursor.Decode(&entry)
+		if err != nil {
+			return errors.Wrap(err, "failed to decode verified client")
+		}
+		if _, ok := seen[entry.ID]; ok {
+			continue
+		}
+		entry.Removed = true
+		entry.Version++
+		entry.UpdatedAt = now
+		err = saveVerifiedClientVersion(ctx, mg, entry, "removed")
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(cursor.Err(), "failed to iterate verified clients")
+}
+
+// updateVerifiedClients syncs every page of verified clients. The API may return fewer entries per page than
+// requested, so pages are fetched until the total it reports is reached. Without a total, pages are fetched until a
+// short page. Clients are only marked as removed if every page was known to be fetched.
+func updateVerifiedClients(ctx context.Context, mg *mongo.Client) error {
+	now := time.Now()
+	seen := make(map[int32]struct{})
+	var fetched, total int
+	for page := 1; ; page++ {
+		clients, count, err := fetchVerifiedClients(ctx, page)
+		if err != nil {
+			return errors.Wrapf(err, "failed to fetch page %d", page)
+		}
+		total = count
+		fetched += len(clients)
+		for _, vClient := range clients {
+			seen[vClient.ID] = struct{}{}
+			err = syncVerifiedClient(ctx, mg, vClient.toVerifiedClient(), now)
+			if err != nil {
+				return errors.Wrapf(err, "failed to sync verified client %d", vClient.ID)
+			}
+		}
+		if len(clients) == 0 || (total < 0 && len(clients) < verifiedClientsPageSize) || (total >= 0 && fetched >= total) {
+			break
+		}
+	}
+	log.Printf("synced %d verified clients\n", len(seen))
+	if len(seen) == 0 {
+		return errors.New("no verified clients returned, refusing to mark every client as removed")
+	}
+	if total < 0 {
+		log.Printf("fetched %d verified clients without a total, not marking missing clients as removed\n", fetched)
+		return nil
+	}
+	if fetched < total {
+		log.Printf("fetched %d of %d verified clients, not marking missing clients as removed\n", fetched, total)
+		return nil
+	}
+	return markRemovedVerifiedClients(ctx, mg, seen, now)
+}